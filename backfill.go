@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"knative.dev/pkg/apis"
+)
+
+// backfillOptions selects the PipelineRuns written by the backfill command.
+type backfillOptions struct {
+	namespace string
+	selector  string
+	since     time.Duration
+	until     time.Duration
+	batchSize int
+	dryRun    bool
+	// results also backfills runs already pruned from the cluster, reading
+	// them from Tekton Results
+	results bool
+}
+
+// backfillSummary counts what happened to each PipelineRun.
+type backfillSummary struct {
+	inserted, skipped, failed int
+}
+
+// runBackfill implements the backfill subcommand, which stores finished
+// PipelineRuns that are still in the cluster but missing from the table.
+func runBackfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	var opts backfillOptions
+	fs.StringVar(&opts.namespace, "namespace", "", "namespace to backfill, all namespaces when empty")
+	fs.StringVar(&opts.selector, "selector", "", "label selector the PipelineRuns must match")
+	fs.DurationVar(&opts.since, "since", 0, "only backfill PipelineRuns started within this duration, all when zero")
+	fs.DurationVar(&opts.until, "until", 0, "skip PipelineRuns started within this duration")
+	fs.IntVar(&opts.batchSize, "batch-size", 25, "number of records written per batch, at most 25")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "report what would be inserted without writing")
+	fs.BoolVar(&opts.results, "results", false, "also backfill pruned PipelineRuns archived in Tekton Results")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if opts.batchSize < 1 || opts.batchSize > 25 {
+		return fmt.Errorf("batch-size must be between 1 and 25, got %d", opts.batchSize)
+	}
+
+	if err := setupResultsFallback(); err != nil {
+		return fmt.Errorf("failed to configure Tekton Results: %w", err)
+	}
+	if err := setupRecordRules(); err != nil {
+		return err
+	}
+	if err := setupActors(nil); err != nil {
+		return err
+	}
+	if opts.results && resultsFallback == nil {
+		return fmt.Errorf("-results requires RESULTS_API_URL to be set")
+	}
+	client, err := newclient()
+	if err != nil {
+		return fmt.Errorf("failed to create dynamoclient: %w", err)
+	}
+	dbClient = client
+	dynamicClient, err := newDynamicClient()
+	if err != nil {
+		return err
+	}
+
+	summary, err := backfill(context.Background(), dynamicClient, opts)
+	fmt.Printf("backfill finished: %d inserted, %d skipped, %d failed\n", summary.inserted, summary.skipped, summary.failed)
+	return err
+}
+
+func backfill(ctx context.Context, client dynamic.Interface, opts backfillOptions) (backfillSummary, error) {
+	var summary backfillSummary
+	now := time.Now()
+	var batch []DynoNotation
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if opts.dryRun {
+			summary.inserted += len(batch)
+		} else if err := putItems(dbClient, "TektonCI", batch); err != nil {
+			log.Printf("failed to write batch of %d runs: %v", len(batch), err)
+			summary.failed += len(batch)
+		} else {
+			summary.inserted += len(batch)
+		}
+		batch = batch[:0]
+	}
+
+	seen := make(map[string]bool)
+	process := func(pr v1.PipelineRun) {
+		if seen[string(pr.UID)] {
+			return
+		}
+		seen[string(pr.UID)] = true
+		if !isTerminal(pr.Status.GetCondition(apis.ConditionSucceeded)) || !inWindow(pr, now, opts) || isChildPipelineRun(pr) || !recordPipelineRun(pr) {
+			summary.skipped++
+			return
+		}
+		existing, err := getBuild(dbClient, "TektonCI", "Tekton", string(pr.UID))
+		if err != nil {
+			log.Printf("failed to look up PipelineRun %s/%s: %v", pr.Namespace, pr.Name, err)
+			summary.failed++
+			return
+		}
+		if existing != nil && existing.CompletedAt != 0 {
+			summary.skipped++
+			return
+		}
+		payload, err := PrepareCiBuildData(client, pr)
+		if err != nil {
+			log.Printf("failed to convert PipelineRun %s/%s: %v", pr.Namespace, pr.Name, err)
+			summary.failed++
+			return
+		}
+		av, err := attributevalue.MarshalMap(payload)
+		if err != nil {
+			log.Printf("failed to marshal PipelineRun %s/%s: %v", pr.Namespace, pr.Name, err)
+			summary.failed++
+			return
+		}
+		batch = append(batch, av)
+		if len(batch) == opts.batchSize {
+			flush()
+		}
+	}
+
+	resource := client.Resource(pipelineRunResource).Namespace(opts.namespace)
+	listOpts := metav1.ListOptions{LabelSelector: opts.selector, Limit: 100}
+	for {
+		list, err := resource.List(ctx, listOpts)
+		if err != nil {
+			flush()
+			return summary, fmt.Errorf("failed to list PipelineRuns: %w", err)
+		}
+		for _, item := range list.Items {
+			var pr v1.PipelineRun
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &pr); err != nil {
+				log.Printf("failed to convert PipelineRun %s/%s: %v", item.GetNamespace(), item.GetName(), err)
+				summary.failed++
+				continue
+			}
+			process(pr)
+		}
+		if list.GetContinue() == "" {
+			break
+		}
+		listOpts.Continue = list.GetContinue()
+	}
+
+	if opts.results {
+		var since time.Time
+		if opts.since > 0 {
+			since = now.Add(-opts.since)
+		}
+		archived, err := resultsFallback.listPipelineRuns(ctx, opts.namespace, since)
+		if err != nil {
+			flush()
+			return summary, fmt.Errorf("failed to list PipelineRuns from Tekton Results: %w", err)
+		}
+		selector, err := labels.Parse(opts.selector)
+		if err != nil {
+			flush()
+			return summary, err
+		}
+		for _, pr := range archived {
+			if selector.Matches(labels.Set(pr.Labels)) {
+				process(pr)
+			}
+		}
+	}
+	flush()
+	return summary, nil
+}
+
+// inWindow reports whether the PipelineRun started inside the time window
+// of the options.
+func inWindow(pr v1.PipelineRun, now time.Time, opts backfillOptions) bool {
+	started := pr.CreationTimestamp.Time
+	if pr.Status.StartTime != nil {
+		started = pr.Status.StartTime.Time
+	}
+	if opts.since > 0 && started.Before(now.Add(-opts.since)) {
+		return false
+	}
+	if opts.until > 0 && started.After(now.Add(-opts.until)) {
+		return false
+	}
+	return true
+}
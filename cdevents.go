@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// cdEventPrefix is the type prefix shared by every CDEvents event. The full
+// type is dev.cdevents.<subject>.<predicate>.<version>.
+const cdEventPrefix = "dev.cdevents."
+
+// CDEvent is the envelope defined by the CDEvents specification.
+type CDEvent struct {
+	Context CDEventContext `json:"context"`
+	Subject CDEventSubject `json:"subject"`
+}
+
+type CDEventContext struct {
+	Version   string    `json:"version"`
+	ID        string    `json:"id"`
+	Source    string    `json:"source"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type CDEventSubject struct {
+	ID      string         `json:"id"`
+	Source  string         `json:"source"`
+	Type    string         `json:"type"`
+	Content CDEventContent `json:"content"`
+}
+
+// CDEventContent holds the union of the subject content fields used by the
+// pipelinerun, taskrun, build and service events.
+type CDEventContent struct {
+	PipelineName string      `json:"pipelineName"`
+	TaskName     string      `json:"taskName"`
+	URL          string      `json:"url"`
+	Outcome      string      `json:"outcome"`
+	Errors       string      `json:"errors"`
+	ArtifactID   string      `json:"artifactId"`
+	PipelineRun  *CDEventRef `json:"pipelineRun"`
+	Environment  *CDEventRef `json:"environment"`
+}
+
+// CDEventRef references another CDEvents subject.
+type CDEventRef struct {
+	ID     string `json:"id"`
+	Source string `json:"source"`
+}
+
+// cdEventHandler stores a decoded CDEvent.
+type cdEventHandler func(ctx context.Context, cde CDEvent) (string, error)
+
+// cdEventHandlers routes CDEvents by "<subject>.<predicate>".
+var cdEventHandlers = map[string]cdEventHandler{
+	"pipelinerun.queued":   handleCDPipelineRunStarted,
+	"pipelinerun.started":  handleCDPipelineRunStarted,
+	"pipelinerun.finished": handleCDPipelineRunFinished,
+	"taskrun.started":      handleCDTaskRun,
+	"taskrun.finished":     handleCDTaskRun,
+	"build.queued":         handleCDBuildStarted,
+	"build.started":        handleCDBuildStarted,
+	"build.finished":       handleCDBuildFinished,
+	"service.deployed":     handleCDServiceDeployed,
+	"service.upgraded":     handleCDServiceDeployed,
+}
+
+// cdEventMetricType returns the type CDEvents events are counted under. The
+// type is chosen by the sender, so kinds without a handler share one label.
+func cdEventMetricType(eventType string) string {
+	kind := cdEventKind(eventType)
+	if _, ok := cdEventHandlers[kind]; !ok {
+		kind = "unknown"
+	}
+	return cdEventPrefix + kind
+}
+
+// cdEventKind strips the prefix and version from a CDEvents type, leaving
+// "<subject>.<predicate>".
+func cdEventKind(eventType string) string {
+	parts := strings.SplitN(strings.TrimPrefix(eventType, cdEventPrefix), ".", 3)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// handleCDEvent decodes a CDEvents event and passes it on to the handler for
+// its subject and predicate. The handlers update builds assembled from
+// several events, so they run under buildMu. CDEvents are only consumed,
+// the listener does not emit any.
+func handleCDEvent(ctx context.Context, event cloudevents.Event) (string, error) {
+	handler, ok := cdEventHandlers[cdEventKind(event.Type())]
+	if !ok {
+		return handleUnknownEvent(ctx, event)
+	}
+	var cde CDEvent
+	if err := json.Unmarshal(eventPayload(event), &cde); err != nil {
+		return "", &conversionError{fmt.Errorf("failed to decode %s payload: %w", event.Type(), err)}
+	}
+	if cde.Context.Type == "" {
+		cde.Context.Type = event.Type()
+	}
+	if cde.Context.Timestamp.IsZero() {
+		cde.Context.Timestamp = event.Time()
+	}
+	buildMu.Lock()
+	defer buildMu.Unlock()
+	return handler(ctx, cde)
+}
+
+// cdEventOutcome maps a CDEvents outcome onto the condition status used for
+// Tekton records.
+func cdEventOutcome(outcome string) string {
+	switch outcome {
+	case "success":
+		return string(corev1.ConditionTrue)
+	case "failure", "error", "cancel":
+		return string(corev1.ConditionFalse)
+	}
+	return string(corev1.ConditionUnknown)
+}
+
+// cdEventBuild returns the stored build for the subject, or a new one when
+// nothing has been recorded for it yet.
+func cdEventBuild(cde CDEvent) (CiBuildPayload, error) {
+	existing, err := getBuild(dbClient, "TektonCI", "CDEvents", cde.Subject.ID)
+	if err != nil {
+		return CiBuildPayload{}, err
+	}
+	if existing != nil {
+		return *existing, nil
+	}
+	return CiBuildPayload{
+		Origin:          "CDEvents",
+		OriginalID:      cde.Subject.ID,
+		Name:            cde.Subject.ID,
+		CreatedAt:       cde.Context.Timestamp.Unix(),
+		PullRequestUrls: make([]string, 0),
+		TriggeredBy: TriggeredBy{
+			Name:      cde.Context.Source,
+			AccountId: cde.Context.Source,
+		},
+	}, nil
+}
+
+// recordCDEvent reports whether the recording rules allow storing the run
+// in the subject. As in the events Tekton emits, the subject ID and source
+// stand in for the run name and namespace. CDEvents carry no labels or
+// annotations, so rules with a selector or annotations never match them.
+func recordCDEvent(subject CDEventSubject, pipelineName string) bool {
+	return recordRules.allows(metav1.ObjectMeta{Name: subject.ID, Namespace: subject.Source}, pipelineName)
+}
+
+func handleCDPipelineRunStarted(ctx context.Context, cde CDEvent) (string, error) {
+	if !recordCDEvent(cde.Subject, cde.Subject.Content.PipelineName) {
+		return outcomeIgnored, nil
+	}
+	payload, err := cdEventBuild(cde)
+	if err != nil {
+		return "", err
+	}
+	applyCDPipelineRun(&payload, cde)
+	payload.StartedAt = cde.Context.Timestamp.Unix()
+	payload.Status = "Succeeded"
+	payload.Conclusion = string(corev1.ConditionUnknown)
+	stored, err := putInProgressItem(dbClient, "TektonCI", payload)
+	if err != nil || !stored {
+		return outcomeIgnored, err
+	}
+	return outcomeStored, nil
+}
+
+func handleCDPipelineRunFinished(ctx context.Context, cde CDEvent) (string, error) {
+	if !recordCDEvent(cde.Subject, cde.Subject.Content.PipelineName) {
+		return outcomeIgnored, nil
+	}
+	payload, err := cdEventBuild(cde)
+	if err != nil {
+		return "", err
+	}
+	applyCDPipelineRun(&payload, cde)
+	payload.CompletedAt = cde.Context.Timestamp.Unix()
+	if payload.StartedAt == 0 {
+		payload.StartedAt = payload.CompletedAt
+	}
+	payload.Status = "Succeeded"
+	payload.Conclusion = cdEventOutcome(cde.Subject.Content.Outcome)
+	stage := cdEventStage(&payload)
+	stage.StartedAt = payload.StartedAt
+	stage.CompletedAt = payload.CompletedAt
+	stage.Status = payload.Conclusion
+	stage.Conclusion = cde.Subject.Content.Outcome
+	if err := storeBuild(dbClient, "TektonCI", payload); err != nil {
+		return "", err
+	}
+	return outcomeStored, nil
+}
+
+// applyCDPipelineRun copies the pipelinerun subject fields onto the build.
+func applyCDPipelineRun(payload *CiBuildPayload, cde CDEvent) {
+	if cde.Subject.Content.PipelineName != "" {
+		payload.Name = cde.Subject.Content.PipelineName
+	}
+	if cde.Subject.Content.URL != "" {
+		payload.URL = cde.Subject.Content.URL
+	}
+	stage := cdEventStage(payload)
+	stage.Name = payload.Name
+	stage.URL = payload.URL
+	classifyCDPipelineRun(payload, cde.Subject)
+}
+
+// classifyCDPipelineRun classifies the pipelinerun build with the deployment
+// rules. Its tasks are the taskruns recorded as its jobs so far, or the task
+// of a standalone taskrun, and it is classified again as jobs are added. CDEvents carry no params, so the subject source
+// stands in for the target namespace as well as the namespace.
+func classifyCDPipelineRun(payload *CiBuildPayload, subject CDEventSubject) {
+	var tasks []string
+	if subject.Content.TaskName != "" {
+		tasks = append(tasks, subject.Content.TaskName)
+	}
+	for _, job := range cdEventStage(payload).Jobs {
+		tasks = append(tasks, job.Name)
+	}
+	pipelineName := payload.Name
+	if pipelineName == subject.ID {
+		pipelineName = ""
+	}
+	payload.IsDeployment, payload.DeploymentRule = classifyDeployment(deploymentRun{
+		meta:            metav1.ObjectMeta{Name: subject.ID, Namespace: subject.Source},
+		pipelineName:    pipelineName,
+		tasks:           tasks,
+		targetNamespace: subject.Source,
+	})
+}
+
+// cdEventStage returns the single stage of a CDEvents build, creating it if
+// needed.
+func cdEventStage(payload *CiBuildPayload) *Stage {
+	if len(payload.Stages) == 0 {
+		payload.Stages = []Stage{{ID: payload.OriginalID, Name: payload.Name}}
+	}
+	return &payload.Stages[0]
+}
+
+// handleCDTaskRun records a taskrun as a job of its pipelinerun, or as a
+// build of its own when it does not belong to one. Taskrun events name no
+// pipeline, so the recording rules match a taskrun of a pipelinerun with
+// the pipeline name stored for the pipelinerun, if any.
+func handleCDTaskRun(ctx context.Context, cde CDEvent) (string, error) {
+	content := cde.Subject.Content
+	finished := cdEventKind(cde.Context.Type) == "taskrun.finished"
+	if content.PipelineRun == nil || content.PipelineRun.ID == "" {
+		if finished {
+			return handleCDPipelineRunFinished(ctx, cdTaskRunAsPipelineRun(cde))
+		}
+		return handleCDPipelineRunStarted(ctx, cdTaskRunAsPipelineRun(cde))
+	}
+
+	parent := cde
+	parent.Subject = CDEventSubject{ID: content.PipelineRun.ID, Source: content.PipelineRun.Source}
+	payload, err := cdEventBuild(parent)
+	if err != nil {
+		return "", err
+	}
+	pipelineName := payload.Name
+	if pipelineName == parent.Subject.ID {
+		pipelineName = ""
+	}
+	if !recordCDEvent(parent.Subject, pipelineName) {
+		return outcomeIgnored, nil
+	}
+	stage := cdEventStage(&payload)
+	name := content.TaskName
+	if name == "" {
+		name = cde.Subject.ID
+	}
+	var job *Job
+	for i := range stage.Jobs {
+		if stage.Jobs[i].Name == name {
+			job = &stage.Jobs[i]
+		}
+	}
+	if job == nil {
+		stage.Jobs = append(stage.Jobs, Job{Name: name})
+		job = &stage.Jobs[len(stage.Jobs)-1]
+	}
+	if finished {
+		job.CompletedAt = cde.Context.Timestamp.Unix()
+		job.Status = cdEventOutcome(content.Outcome)
+		job.Conclusion = content.Outcome
+	} else {
+		job.StartedAt = cde.Context.Timestamp.Unix()
+		job.Status = string(corev1.ConditionUnknown)
+		job.Conclusion = "Running"
+	}
+	classifyCDPipelineRun(&payload, parent.Subject)
+	return storeBuildState(payload)
+}
+
+// cdTaskRunAsPipelineRun lets a standalone taskrun be stored like a
+// pipelinerun with the task name as the build name.
+func cdTaskRunAsPipelineRun(cde CDEvent) CDEvent {
+	cde.Subject.Content.PipelineName = cde.Subject.Content.TaskName
+	return cde
+}
+
+func handleCDBuildStarted(ctx context.Context, cde CDEvent) (string, error) {
+	payload, err := cdEventBuild(cde)
+	if err != nil {
+		return "", err
+	}
+	payload.StartedAt = cde.Context.Timestamp.Unix()
+	payload.Status = "Succeeded"
+	payload.Conclusion = string(corev1.ConditionUnknown)
+	stored, err := putInProgressItem(dbClient, "TektonCI", payload)
+	if err != nil || !stored {
+		return outcomeIgnored, err
+	}
+	return outcomeStored, nil
+}
+
+// handleCDBuildFinished completes a build. The spec carries no outcome for
+// builds, a finished build with an artifact is treated as successful.
+func handleCDBuildFinished(ctx context.Context, cde CDEvent) (string, error) {
+	payload, err := cdEventBuild(cde)
+	if err != nil {
+		return "", err
+	}
+	payload.CompletedAt = cde.Context.Timestamp.Unix()
+	if payload.StartedAt == 0 {
+		payload.StartedAt = payload.CompletedAt
+	}
+	payload.Status = "Succeeded"
+	payload.Conclusion = string(corev1.ConditionUnknown)
+	if cde.Subject.Content.ArtifactID != "" {
+		payload.Conclusion = string(corev1.ConditionTrue)
+		payload.URL = cde.Subject.Content.ArtifactID
+	}
+	if err := storeBuild(dbClient, "TektonCI", payload); err != nil {
+		return "", err
+	}
+	return outcomeStored, nil
+}
+
+// handleCDServiceDeployed records a deployment or upgrade of an artifact to
+// an environment as a completed deployment build. Every deployment of a
+// service is a separate record, keyed by the event ID.
+func handleCDServiceDeployed(ctx context.Context, cde CDEvent) (string, error) {
+	deployment := cde
+	deployment.Subject.ID = cde.Context.ID
+	payload, err := cdEventBuild(deployment)
+	if err != nil {
+		return "", err
+	}
+	payload.Name = cde.Subject.ID
+	content := cde.Subject.Content
+	if content.Environment != nil && content.Environment.ID != "" {
+		payload.Name = fmt.Sprintf("%s to %s", cde.Subject.ID, content.Environment.ID)
+	}
+	payload.URL = content.ArtifactID
+	payload.StartedAt = cde.Context.Timestamp.Unix()
+	payload.CompletedAt = cde.Context.Timestamp.Unix()
+	payload.Status = "Succeeded"
+	payload.Conclusion = string(corev1.ConditionTrue)
+	payload.IsDeployment = true
+	if err := storeBuild(dbClient, "TektonCI", payload); err != nil {
+		return "", err
+	}
+	return outcomeStored, nil
+}
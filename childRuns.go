@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline"
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	runv1beta1 "github.com/tektoncd/pipeline/pkg/apis/run/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"knative.dev/pkg/apis"
+)
+
+// maxChildDepth bounds how deeply nested PipelineRuns are expanded.
+const maxChildDepth = 5
+
+// CustomRun is the part of a tekton.dev/v1beta1 CustomRun the listener
+// reads. Custom tasks such as approvals, waits and Pipelines in Pipelines
+// run as CustomRuns.
+type CustomRun struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              struct {
+		CustomRef *struct {
+			APIVersion string `json:"apiVersion,omitempty"`
+			Kind       string `json:"kind,omitempty"`
+			Name       string `json:"name,omitempty"`
+		} `json:"customRef,omitempty"`
+	} `json:"spec,omitempty"`
+	Status runv1beta1.CustomRunStatus `json:"status,omitempty"`
+}
+
+// stageCollector turns the children of a PipelineRun into stages. Child
+// PipelineRuns, referenced directly or created by a CustomRun, are expanded
+// into stages of their own named after the path to them.
+type stageCollector struct {
+	ctx    context.Context
+	client dynamic.Interface
+	// visited holds the UIDs of the PipelineRuns already expanded
+	visited map[types.UID]bool
+}
+
+func newStageCollector(ctx context.Context, client dynamic.Interface) *stageCollector {
+	return &stageCollector{
+		ctx:     ctx,
+		client:  client,
+		visited: make(map[types.UID]bool),
+	}
+}
+
+// stages returns the stages of the children of obj, nested under the
+// stage named parent, which is empty for the top-level PipelineRun.
+func (c *stageCollector) stages(obj v1.PipelineRun, parent string, depth int) []Stage {
+	c.visited[obj.UID] = true
+	finally := finallyTasks(obj)
+	var stg []Stage
+	for _, val := range obj.Status.ChildReferences {
+		name := val.PipelineTaskName
+		if name == "" {
+			name = val.Name
+		}
+		if parent != "" {
+			name = parent + "/" + name
+		}
+		var stage Stage
+		var children []Stage
+		switch val.Kind {
+		case "TaskRun":
+			task, err := getTaskRun(c.ctx, c.client.Resource(taskRunResource).Namespace(obj.Namespace), obj.Namespace, val.Name)
+			if err != nil {
+				log.Printf("failed to get TaskRun %s/%s: %v", obj.Namespace, val.Name, err)
+				stg = append(stg, missingStage(name, parent, finally[val.PipelineTaskName], missingTaskRun))
+				continue
+			}
+			stage = taskRunToStage(name, *task, finally[val.PipelineTaskName])
+		case "PipelineRun":
+			child, err := c.getPipelineRun(obj.Namespace, val.Name)
+			if err != nil {
+				log.Printf("failed to get PipelineRun %s/%s: %v", obj.Namespace, val.Name, err)
+				stg = append(stg, missingStage(name, parent, finally[val.PipelineTaskName], missingPipelineRun))
+				continue
+			}
+			stage = pipelineRunToStage(name, *child, finally[val.PipelineTaskName])
+			children = c.expand(*child, name, depth)
+		case "CustomRun":
+			run, err := c.getCustomRun(obj.Namespace, val.Name)
+			if err != nil {
+				log.Printf("failed to get CustomRun %s/%s: %v", obj.Namespace, val.Name, err)
+				stg = append(stg, missingStage(name, parent, finally[val.PipelineTaskName], missingCustomRun))
+				continue
+			}
+			stage = customRunToStage(name, *run, finally[val.PipelineTaskName])
+			for _, child := range c.ownedPipelineRuns(*run) {
+				childName := name + "/" + child.Name
+				childStage := pipelineRunToStage(childName, child, false)
+				childStage.Parent = name
+				children = append(children, childStage)
+				children = append(children, c.expand(child, childName, depth)...)
+			}
+		default:
+			continue
+		}
+		stage.Parent = parent
+		stg = append(stg, stage)
+		stg = append(stg, children...)
+	}
+	return stg
+}
+
+// expand returns the stages of a child PipelineRun, unless it was already
+// expanded or is nested too deeply.
+func (c *stageCollector) expand(child v1.PipelineRun, name string, depth int) []Stage {
+	if c.visited[child.UID] || depth >= maxChildDepth {
+		return nil
+	}
+	return c.stages(child, name, depth+1)
+}
+
+// getPipelineRun fetches a child PipelineRun from the cluster, falling back
+// to Tekton Results when it has already been pruned.
+func (c *stageCollector) getPipelineRun(namespace, name string) (*v1.PipelineRun, error) {
+	u, err := c.client.Resource(pipelineRunResource).Namespace(namespace).Get(c.ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if resultsFallback != nil && apierrors.IsNotFound(err) {
+			return resultsFallback.getPipelineRun(c.ctx, namespace, name)
+		}
+		return nil, err
+	}
+	var pr v1.PipelineRun
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &pr); err != nil {
+		return nil, err
+	}
+	return &pr, nil
+}
+
+func (c *stageCollector) getCustomRun(namespace, name string) (*CustomRun, error) {
+	u, err := c.client.Resource(customRunResource).Namespace(namespace).Get(c.ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var run CustomRun
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// ownedPipelineRuns returns the PipelineRuns owned by the CustomRun, such
+// as those a Pipelines in Pipelines CustomRun creates. Their controller
+// labels them with the CustomRun name, so only those are listed.
+func (c *stageCollector) ownedPipelineRuns(run CustomRun) []v1.PipelineRun {
+	opts := metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{pipeline.CustomRunKey: run.Name}).String(),
+		Limit:         100,
+	}
+	var owned []v1.PipelineRun
+	for {
+		list, err := c.client.Resource(pipelineRunResource).Namespace(run.Namespace).List(c.ctx, opts)
+		if err != nil {
+			log.Printf("failed to list PipelineRuns of CustomRun %s/%s: %v", run.Namespace, run.Name, err)
+			return owned
+		}
+		for _, item := range list.Items {
+			var pr v1.PipelineRun
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &pr); err != nil {
+				continue
+			}
+			if ownedBy(pr.ObjectMeta, run.UID) {
+				owned = append(owned, pr)
+			}
+		}
+		if list.GetContinue() == "" {
+			return owned
+		}
+		opts.Continue = list.GetContinue()
+	}
+}
+
+// ownedBy reports whether the object is owned by the object with the UID.
+func ownedBy(meta metav1.ObjectMeta, owner types.UID) bool {
+	for _, ref := range meta.OwnerReferences {
+		if ref.UID == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// isChildPipelineRun reports whether the PipelineRun was created by another
+// PipelineRun or by a CustomRun. Such runs are recorded as stages of the
+// top-level PipelineRun, not as builds of their own.
+func isChildPipelineRun(obj v1.PipelineRun) bool {
+	for _, ref := range obj.OwnerReferences {
+		if ref.Kind == pipeline.PipelineRunControllerName || ref.Kind == pipeline.CustomRunControllerName {
+			return true
+		}
+	}
+	return false
+}
+
+// pipelineRunToStage converts a child PipelineRun into a stage, its own
+// tasks become stages nested under it.
+func pipelineRunToStage(name string, obj v1.PipelineRun, finally bool) Stage {
+	cond := succeededCondition(obj.Status.GetCondition(apis.ConditionSucceeded))
+	return Stage{
+		ID:            string(obj.UID),
+		Name:          name,
+		StartedAt:     unixTime(obj.Status.StartTime),
+		CompletedAt:   runCompletionTime(obj.Status.CompletionTime, cond),
+		Status:        string(cond.Status),
+		Conclusion:    cond.Reason,
+		URL:           pipelineRunSourceURI(obj),
+		Finally:       finally,
+		MissingFields: missingRunFields(obj.Status.StartTime, obj.Status.CompletionTime, obj.Status.GetCondition(apis.ConditionSucceeded)),
+	}
+}
+
+// customRunToStage converts a CustomRun into a stage without jobs, custom
+// task controllers do not report steps.
+func customRunToStage(name string, obj CustomRun, finally bool) Stage {
+	cond := succeededCondition(obj.Status.GetCondition(apis.ConditionSucceeded))
+	return Stage{
+		ID:            string(obj.UID),
+		Name:          name,
+		StartedAt:     unixTime(obj.Status.StartTime),
+		CompletedAt:   runCompletionTime(obj.Status.CompletionTime, cond),
+		Status:        string(cond.Status),
+		Conclusion:    cond.Reason,
+		Finally:       finally,
+		MissingFields: missingRunFields(obj.Status.StartTime, obj.Status.CompletionTime, obj.Status.GetCondition(apis.ConditionSucceeded)),
+	}
+}
+
+// missingStage stands in for a child run that could not be fetched.
+func missingStage(name, parent string, finally bool, missing string) Stage {
+	return Stage{
+		Name:          name,
+		Status:        string(corev1.ConditionUnknown),
+		Parent:        parent,
+		Finally:       finally,
+		MissingFields: []string{missing},
+	}
+}
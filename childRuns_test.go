@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline"
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/fake"
+	"knative.dev/pkg/apis"
+)
+
+// newFakeKube returns a fake dynamic client serving the Tekton runs.
+func newFakeKube(t *testing.T, runs ...interface{}) *fake.FakeDynamicClient {
+	t.Helper()
+	var objects []runtime.Object
+	for _, run := range runs {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(run)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := &unstructured.Unstructured{Object: content}
+		switch run.(type) {
+		case *v1.PipelineRun:
+			u.SetAPIVersion("tekton.dev/v1")
+			u.SetKind("PipelineRun")
+		case *v1.TaskRun:
+			u.SetAPIVersion("tekton.dev/v1")
+			u.SetKind("TaskRun")
+		case *CustomRun:
+			u.SetAPIVersion("tekton.dev/v1beta1")
+			u.SetKind("CustomRun")
+		default:
+			t.Fatalf("unsupported run %T", run)
+		}
+		objects = append(objects, u)
+	}
+	return fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		pipelineRunResource: "PipelineRunList",
+		taskRunResource:     "TaskRunList",
+		customRunResource:   "CustomRunList",
+	}, objects...)
+}
+
+// pagedKube serves lists pageSize items at a time, the fake client ignores
+// the limit and continue token.
+type pagedKube struct {
+	dynamic.Interface
+	pageSize int
+	// lists counts the list requests
+	lists *int
+}
+
+func (k pagedKube) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return pagedResource{NamespaceableResourceInterface: k.Interface.Resource(resource), kube: k}
+}
+
+type pagedResource struct {
+	dynamic.NamespaceableResourceInterface
+	kube pagedKube
+}
+
+func (r pagedResource) Namespace(namespace string) dynamic.ResourceInterface {
+	return pagedNamespace{ResourceInterface: r.NamespaceableResourceInterface.Namespace(namespace), kube: r.kube}
+}
+
+type pagedNamespace struct {
+	dynamic.ResourceInterface
+	kube pagedKube
+}
+
+func (r pagedNamespace) List(ctx context.Context, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	*r.kube.lists++
+	if opts.Limit == 0 {
+		return nil, fmt.Errorf("list without a limit")
+	}
+	list, err := r.ResourceInterface.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	start := 0
+	if opts.Continue != "" {
+		if start, err = strconv.Atoi(opts.Continue); err != nil {
+			return nil, err
+		}
+	}
+	all := list.Items
+	end := min(start+r.kube.pageSize, len(all))
+	list.Items = all[start:end]
+	list.SetContinue("")
+	if end < len(all) {
+		list.SetContinue(strconv.Itoa(end))
+	}
+	return list, nil
+}
+
+// testRunStart and testRunEnd are the times every test run ran between.
+var (
+	testRunStart = metav1.NewTime(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC))
+	testRunEnd   = metav1.NewTime(time.Date(2024, 5, 1, 10, 5, 0, 0, time.UTC))
+)
+
+func testPipelineRun(name string, children ...v1.ChildStatusReference) *v1.PipelineRun {
+	pr := &v1.PipelineRun{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ci", UID: types.UID("uid-" + name)}}
+	pr.Status.ChildReferences = children
+	pr.Status.StartTime, pr.Status.CompletionTime = &testRunStart, &testRunEnd
+	pr.Status.SetCondition(&apis.Condition{Type: apis.ConditionSucceeded, Status: corev1.ConditionTrue, Reason: "Succeeded"})
+	return pr
+}
+
+func testTaskRun(name string) *v1.TaskRun {
+	tr := &v1.TaskRun{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ci", UID: types.UID("uid-" + name)}}
+	tr.Status.StartTime, tr.Status.CompletionTime = &testRunStart, &testRunEnd
+	tr.Status.SetCondition(&apis.Condition{Type: apis.ConditionSucceeded, Status: corev1.ConditionTrue, Reason: "Succeeded"})
+	return tr
+}
+
+func testCustomRun(name string) *CustomRun {
+	run := &CustomRun{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ci", UID: types.UID("uid-" + name)}}
+	run.Status.StartTime, run.Status.CompletionTime = &testRunStart, &testRunEnd
+	run.Status.SetCondition(&apis.Condition{Type: apis.ConditionSucceeded, Status: corev1.ConditionTrue, Reason: "Succeeded"})
+	return run
+}
+
+// ownedChild returns a PipelineRun created by the CustomRun.
+func ownedChild(name string, owner *CustomRun, children ...v1.ChildStatusReference) *v1.PipelineRun {
+	pr := testPipelineRun(name, children...)
+	pr.Labels = map[string]string{pipeline.CustomRunKey: owner.Name}
+	pr.OwnerReferences = []metav1.OwnerReference{{Kind: pipeline.CustomRunControllerName, Name: owner.Name, UID: owner.UID}}
+	return pr
+}
+
+func childRef(kind, name, pipelineTask string) v1.ChildStatusReference {
+	return v1.ChildStatusReference{TypeMeta: runtime.TypeMeta{Kind: kind}, Name: name, PipelineTaskName: pipelineTask}
+}
+
+// stageSummary lists the name, parent and missing fields of the stages.
+func stageSummary(stages []Stage) []string {
+	var summary []string
+	for _, stage := range stages {
+		line := stage.Name + " < " + stage.Parent
+		if len(stage.MissingFields) > 0 {
+			line += " missing " + strings.Join(stage.MissingFields, ",")
+		}
+		summary = append(summary, line)
+	}
+	return summary
+}
+
+func TestStageCollectorChildren(t *testing.T) {
+	approval := testCustomRun("release-approve")
+	// a CustomRun of another PipelineRun with the same name
+	other := testCustomRun("release-approve")
+	other.UID = "uid-other"
+
+	tests := []struct {
+		name string
+		top  *v1.PipelineRun
+		runs []interface{}
+		want []string
+	}{
+		{
+			name: "CustomRun owning a child PipelineRun",
+			top: testPipelineRun("release",
+				childRef("TaskRun", "release-build", "build"),
+				childRef("CustomRun", "release-approve", "approve")),
+			runs: []interface{}{
+				testTaskRun("release-build"),
+				approval,
+				ownedChild("release-approve-child", approval, childRef("TaskRun", "release-approve-child-test", "test")),
+				ownedChild("stale-child", other),
+				testTaskRun("release-approve-child-test"),
+			},
+			want: []string{
+				"build < ",
+				"approve < ",
+				"approve/release-approve-child < approve",
+				"approve/release-approve-child/test < approve/release-approve-child",
+			},
+		},
+		{
+			name: "child PipelineRun",
+			top:  testPipelineRun("release", childRef("PipelineRun", "release-deploy", "deploy")),
+			runs: []interface{}{
+				testPipelineRun("release-deploy", childRef("TaskRun", "release-deploy-apply", "apply")),
+				testTaskRun("release-deploy-apply"),
+			},
+			want: []string{"deploy < ", "deploy/apply < deploy"},
+		},
+		{
+			name: "cycle",
+			top:  testPipelineRun("a", childRef("PipelineRun", "b", "b")),
+			runs: []interface{}{
+				testPipelineRun("b", childRef("PipelineRun", "a", "a")),
+				testPipelineRun("a", childRef("PipelineRun", "b", "b")),
+			},
+			want: []string{"b < ", "b/a < b"},
+		},
+		{
+			name: "missing children",
+			top: testPipelineRun("release",
+				childRef("TaskRun", "release-build", "build"),
+				childRef("PipelineRun", "release-deploy", "deploy"),
+				childRef("CustomRun", "release-approve", "approve")),
+			want: []string{
+				"build <  missing " + missingTaskRun,
+				"deploy <  missing " + missingPipelineRun,
+				"approve <  missing " + missingCustomRun,
+			},
+		},
+		{
+			name: "missing nested child",
+			top:  testPipelineRun("release", childRef("PipelineRun", "release-deploy", "deploy")),
+			runs: []interface{}{testPipelineRun("release-deploy", childRef("TaskRun", "release-deploy-apply", "apply"))},
+			want: []string{"deploy < ", "deploy/apply < deploy missing " + missingTaskRun},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kube := newFakeKube(t, tt.runs...)
+			stages := newStageCollector(context.Background(), kube).stages(*tt.top, "", 0)
+			if got := stageSummary(stages); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stages =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestStageCollectorMaxDepth(t *testing.T) {
+	var runs []interface{}
+	for i := 1; i <= maxChildDepth+2; i++ {
+		runs = append(runs, testPipelineRun(fmt.Sprintf("run-%d", i), childRef("PipelineRun", fmt.Sprintf("run-%d", i+1), "nested")))
+	}
+	top := testPipelineRun("run-0", childRef("PipelineRun", "run-1", "nested"))
+	stages := newStageCollector(context.Background(), newFakeKube(t, runs...)).stages(*top, "", 0)
+	if len(stages) != maxChildDepth+1 {
+		t.Errorf("%d stages, want the %d levels down to the maximum depth: %s", len(stages), maxChildDepth+1, stageSummary(stages))
+	}
+}
+
+func TestOwnedPipelineRunsPaginates(t *testing.T) {
+	run := testCustomRun("release-approve")
+	other := testCustomRun("other")
+	runs := []interface{}{run}
+	var want []string
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("child-%d", i)
+		runs = append(runs, ownedChild(name, run))
+		want = append(want, name)
+	}
+	// labelled with the CustomRun name but owned by another CustomRun
+	stale := ownedChild("stale", other)
+	stale.Labels[pipeline.CustomRunKey] = run.Name
+	runs = append(runs, stale, ownedChild("unrelated", other))
+
+	lists := 0
+	kube := pagedKube{Interface: newFakeKube(t, runs...), pageSize: 2, lists: &lists}
+	var got []string
+	for _, pr := range newStageCollector(context.Background(), kube).ownedPipelineRuns(*run) {
+		got = append(got, pr.Name)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("owned PipelineRuns = %v, want %v", got, want)
+	}
+	if lists != 3 {
+		t.Errorf("%d list requests, want 3 pages", lists)
+	}
+}
+
+func TestIsChildPipelineRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		owners []metav1.OwnerReference
+		want   bool
+	}{
+		{name: "no owner"},
+		{name: "PipelineRun", owners: []metav1.OwnerReference{{Kind: "PipelineRun", Name: "parent"}}, want: true},
+		{name: "CustomRun", owners: []metav1.OwnerReference{{Kind: "CustomRun", Name: "approve"}}, want: true},
+		{name: "other owner", owners: []metav1.OwnerReference{{Kind: "Application", Name: "app"}}},
+		{
+			name:   "among other owners",
+			owners: []metav1.OwnerReference{{Kind: "Application", Name: "app"}, {Kind: "CustomRun", Name: "approve"}},
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr := v1.PipelineRun{ObjectMeta: metav1.ObjectMeta{OwnerReferences: tt.owners}}
+			if got := isChildPipelineRun(pr); got != tt.want {
+				t.Errorf("isChildPipelineRun = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareCiBuildDataWithChildren(t *testing.T) {
+	top := testPipelineRun("release", childRef("TaskRun", "release-build", "build"))
+	payload, err := PrepareCiBuildData(newFakeKube(t, testTaskRun("release-build")), *top)
+	if err != nil {
+		t.Fatalf("PrepareCiBuildData: %v", err)
+	}
+	if got := stageSummary(payload.Stages); !reflect.DeepEqual(got, []string{"build < "}) {
+		t.Errorf("stages = %v, want the build stage", got)
+	}
+	if _, err := PrepareCiBuildData(newFakeKube(t), v1.PipelineRun{}); err == nil {
+		t.Error("a PipelineRun without UID was converted")
+	}
+}
@@ -14,16 +14,33 @@ type CiBuildPayload struct {
 	RepoURL         string      `json:"repoUrl" dynamodbav:"repoUrl,omitempty"`
 	Commit          string      `json:"commit" dynamodbav:"commit,omitempty"`
 	PullRequestUrls []string    `json:"pullRequestUrls" dynamodbav:"pullrequestUrls,omitempty"`
+	Branch          string      `json:"branch,omitempty" dynamodbav:"branch,omitempty"`
+	EventType       string      `json:"eventType,omitempty" dynamodbav:"eventType,omitempty"`
 	IsDeployment    bool        `json:"isDeployment" dynamodbav:"isDeployment,omitempty"`
 	Stages          []Stage     `json:"stages" dynamodbav:"stages,omitempty"`
+	// DeploymentRule names the classification rule that made the build a
+	// deployment
+	DeploymentRule string `json:"deploymentRule,omitempty" dynamodbav:"deploymentRule,omitempty"`
+	// MissingFields names the data the source did not provide, so partial
+	// records can be told apart from complete ones
+	MissingFields []string `json:"missingFields,omitempty" dynamodbav:"missingFields,omitempty"`
 }
 
 type Job struct {
+	// ID identifies the job at its source, such as a GitLab job ID, where
+	// the name does not
+	ID          string `json:"id,omitempty" dynamodbav:"id,omitempty"`
 	StartedAt   int64  `json:"startedAt" dynamodbav:"startedAt,omitempty"`
 	CompletedAt int64  `json:"completedAt" dynamodbav:"completedAt,omitempty"`
 	Name        string `json:"name" dynamodbav:"name,omitempty"`
 	Status      string `json:"status" dynamodbav:"status,omitempty"`
 	Conclusion  string `json:"conclusion" dynamodbav:"conslusion,omitempty"`
+	// ExitCode is set for jobs that ran a process, such as Tekton steps
+	ExitCode *int32 `json:"exitCode,omitempty" dynamodbav:"exitCode,omitempty"`
+	// Attempt is the attempt of the stage the job ran in, starting at 1
+	Attempt int `json:"attempt,omitempty" dynamodbav:"attempt,omitempty"`
+	// MissingFields names the data the source did not provide
+	MissingFields []string `json:"missingFields,omitempty" dynamodbav:"missingFields,omitempty"`
 }
 
 type TriggeredBy struct {
@@ -41,5 +58,19 @@ type Stage struct {
 	Status      string `json:"status" dynamodbav:"status,omitempty"`
 	Conclusion  string `json:"conclusion" dynamodbav:"conslusion,omitempty"`
 	URL         string `json:"url" dynamodbav:"url,omitempty"`
-	Jobs        []Job  `json:"jobs" dynamodbav:"jobs,omitempty"`
+	// Attempt is the run attempt the stage belongs to, starting at 1
+	Attempt int `json:"attempt,omitempty" dynamodbav:"attempt,omitempty"`
+	// RunnerLabels are the labels of the runner the stage ran on
+	RunnerLabels []string `json:"runnerLabels,omitempty" dynamodbav:"runnerLabels,omitempty"`
+	Jobs         []Job    `json:"jobs" dynamodbav:"jobs,omitempty"`
+	// Retries counts the attempts before the final one
+	Retries int `json:"retries,omitempty" dynamodbav:"retries,omitempty"`
+	// Parent names the stage this stage is nested under, such as the
+	// Pipelines in Pipelines task that ran a child PipelineRun
+	Parent string `json:"parent,omitempty" dynamodbav:"parent,omitempty"`
+	// Finally marks stages of Tekton finally tasks, which run after all
+	// other tasks whatever their outcome
+	Finally bool `json:"finally,omitempty" dynamodbav:"finally,omitempty"`
+	// MissingFields names the data the source did not provide
+	MissingFields []string `json:"missingFields,omitempty" dynamodbav:"missingFields,omitempty"`
 }
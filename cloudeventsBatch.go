@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+// batchContentType is the media type of the JSON batch content mode.
+const batchContentType = "application/cloudevents-batch+json"
+
+// batchResult reports whether a single event of a batch was accepted, and
+// for rejected events whether sending it again can succeed.
+type batchResult struct {
+	ID        string `json:"id"`
+	Accepted  bool   `json:"accepted"`
+	Retryable bool   `json:"retryable,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// batchReceiver fans batched CloudEvents out to fn and passes binary and
+// structured mode requests on to the CloudEvents SDK receiver, which
+// decodes both.
+//
+// A batch is answered with the result of each event, in order. When every
+// event is accepted the status is 200. When none is and at least one
+// failure is retryable the status is 503, so that relays redeliver the
+// whole batch. Otherwise the status is 207 and senders must resend the
+// events marked retryable themselves; the others fail however often they
+// are sent.
+type batchReceiver struct {
+	single http.Handler
+	fn     receiverFunc
+}
+
+func (h *batchReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != batchContentType {
+		h.single.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	var events []cloudevents.Event
+	if err := json.Unmarshal(body, &events); err != nil {
+		http.Error(w, "invalid CloudEvents batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results, accepted := receiveBatch(r.Context(), events, h.fn)
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case accepted == len(results):
+	case accepted == 0 && anyRetryable(results):
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Printf("failed to write batch response: %v", err)
+	}
+}
+
+// receiveBatch hands each event to fn and returns the result of every
+// event along with the number accepted.
+func receiveBatch(ctx context.Context, events []cloudevents.Event, fn receiverFunc) ([]batchResult, int) {
+	results := make([]batchResult, 0, len(events))
+	accepted := 0
+	for _, event := range events {
+		result := batchResult{ID: event.ID(), Accepted: true}
+		if err := event.Validate(); err != nil {
+			result.Accepted = false
+			result.Error = err.Error()
+		} else if err := fn(ctx, event); err != nil {
+			result.Accepted = false
+			result.Retryable = !isPermanent(err)
+			result.Error = err.Error()
+		}
+		if result.Accepted {
+			accepted++
+		}
+		results = append(results, result)
+	}
+	return results, accepted
+}
+
+func anyRetryable(results []batchResult) bool {
+	for _, result := range results {
+		if result.Retryable {
+			return true
+		}
+	}
+	return false
+}
+
+// eventPayload returns the data of the event. Relays sometimes carry the
+// JSON payload as a JSON string, in which case it is unquoted.
+func eventPayload(event cloudevents.Event) []byte {
+	data := bytes.TrimSpace(event.Data())
+	if len(data) > 0 && data[0] == '"' {
+		var embedded string
+		if err := json.Unmarshal(data, &embedded); err == nil {
+			return []byte(embedded)
+		}
+	}
+	return data
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+// newTestReceiver serves fn on the HTTP transport without credentials.
+func newTestReceiver(t *testing.T, fn receiverFunc) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	transport := &httpTransport{mux: mux, path: "/", auth: &eventAuth{}}
+	if err := transport.start(context.Background(), fn); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// failingReceiver fails the events whose ID names a failure.
+func failingReceiver(ctx context.Context, event cloudevents.Event) error {
+	switch {
+	case strings.HasPrefix(event.ID(), "retryable"):
+		return errors.New("store unavailable")
+	case strings.HasPrefix(event.ID(), "permanent"):
+		return &conversionError{errors.New("not a PipelineRun")}
+	}
+	return nil
+}
+
+func batchEvent(id string) map[string]interface{} {
+	return map[string]interface{}{
+		"specversion": "1.0",
+		"id":          id,
+		"source":      "/tekton",
+		"type":        pipelineRunSuccessfulEvent,
+		"data":        map[string]interface{}{},
+	}
+}
+
+func TestBatchReceiver(t *testing.T) {
+	server := newTestReceiver(t, failingReceiver)
+	invalid := batchEvent("invalid")
+	delete(invalid, "type")
+
+	tests := []struct {
+		name    string
+		events  []map[string]interface{}
+		status  int
+		results []batchResult
+	}{
+		{
+			name:    "all accepted",
+			events:  []map[string]interface{}{batchEvent("a"), batchEvent("b")},
+			status:  http.StatusOK,
+			results: []batchResult{{ID: "a", Accepted: true}, {ID: "b", Accepted: true}},
+		},
+		{
+			name:   "mixed",
+			events: []map[string]interface{}{batchEvent("a"), batchEvent("retryable-1"), batchEvent("permanent-1"), invalid},
+			status: http.StatusMultiStatus,
+			results: []batchResult{
+				{ID: "a", Accepted: true},
+				{ID: "retryable-1", Retryable: true},
+				{ID: "permanent-1"},
+				{ID: "invalid"},
+			},
+		},
+		{
+			name:    "all failed retryably",
+			events:  []map[string]interface{}{batchEvent("retryable-1"), batchEvent("retryable-2")},
+			status:  http.StatusServiceUnavailable,
+			results: []batchResult{{ID: "retryable-1", Retryable: true}, {ID: "retryable-2", Retryable: true}},
+		},
+		{
+			name:    "all failed, some permanently",
+			events:  []map[string]interface{}{batchEvent("retryable-1"), batchEvent("permanent-1")},
+			status:  http.StatusServiceUnavailable,
+			results: []batchResult{{ID: "retryable-1", Retryable: true}, {ID: "permanent-1"}},
+		},
+		{
+			name:    "all failed permanently",
+			events:  []map[string]interface{}{batchEvent("permanent-1")},
+			status:  http.StatusMultiStatus,
+			results: []batchResult{{ID: "permanent-1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(tt.events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.Post(server.URL, batchContentType, strings.NewReader(string(body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			var results []batchResult
+			if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+				t.Fatal(err)
+			}
+			for i := range results {
+				if !results[i].Accepted && results[i].Error == "" {
+					t.Errorf("result %d has no error", i)
+				}
+				results[i].Error = ""
+			}
+			if !reflect.DeepEqual(results, tt.results) {
+				t.Errorf("results = %+v, want %+v", results, tt.results)
+			}
+		})
+	}
+}
+
+func TestBatchReceiverRejectsInvalidBatch(t *testing.T) {
+	server := newTestReceiver(t, failingReceiver)
+	resp, err := http.Post(server.URL, batchContentType, strings.NewReader(`{"id": "not a batch"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", resp.StatusCode)
+	}
+}
+
+// TestStringEmbeddedPayload checks that structured and batched events
+// whose data is the JSON payload encoded as a JSON string are decoded.
+func TestStringEmbeddedPayload(t *testing.T) {
+	var mu sync.Mutex
+	var uids []string
+	server := newTestReceiver(t, func(ctx context.Context, event cloudevents.Event) error {
+		dat, err := decodeTektonEvent(event)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		uids = append(uids, string(dat.Pipelinerun.UID))
+		mu.Unlock()
+		return nil
+	})
+	event := batchEvent("structured")
+	event["datacontenttype"] = "application/json"
+	event["data"] = `{"pipelineRun": {"metadata": {"name": "build", "uid": "uid-1"}}}`
+	body, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(server.URL, "application/cloudevents+json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		t.Errorf("structured status = %d, want success", resp.StatusCode)
+	}
+
+	event["id"] = "batched"
+	event["data"] = `{"pipelineRun": {"metadata": {"name": "build", "uid": "uid-2"}}}`
+	body, err = json.Marshal([]interface{}{event})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Post(server.URL, batchContentType, strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("batch status = %d, want 200", resp.StatusCode)
+	}
+	if got := strings.Join(uids, ","); got != "uid-1,uid-2" {
+		t.Errorf("decoded PipelineRuns %s, want uid-1,uid-2", got)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+// deadLetters keeps the events that could not be converted. It is nil when
+// neither DEAD_LETTER_DIR nor DEAD_LETTER_TABLE is set.
+var deadLetters deadLetterStore
+
+// DeadLetter is an event that could not be converted into a build, kept
+// with the error so it can be replayed once the mapping is fixed.
+type DeadLetter struct {
+	ID        string          `json:"id" dynamodbav:"id"`
+	EventID   string          `json:"eventID" dynamodbav:"eventID"`
+	EventType string          `json:"eventType" dynamodbav:"eventType"`
+	Event     json.RawMessage `json:"event" dynamodbav:"event"`
+	Error     string          `json:"error" dynamodbav:"error"`
+	FailedAt  int64           `json:"failedAt" dynamodbav:"failedAt"`
+}
+
+// deadLetterStore persists dead letters. get returns nil when there is no
+// letter with the ID.
+type deadLetterStore interface {
+	put(letter DeadLetter) error
+	list() ([]DeadLetter, error)
+	get(id string) (*DeadLetter, error)
+	remove(id string) error
+}
+
+// putDeadLetter stores the event along with the error it failed with.
+func putDeadLetter(event cloudevents.Event, cause error) error {
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	return putDeadLetterData(event.ID(), event.Type(), []byte(eventKey(event)), raw, cause)
+}
+
+// putDeadRecord stores a transport record that does not hold a valid
+// CloudEvent. Records that are not JSON are kept as a JSON string.
+func putDeadRecord(value []byte, cause error) error {
+	raw := json.RawMessage(value)
+	if !json.Valid(value) {
+		quoted, err := json.Marshal(string(value))
+		if err != nil {
+			return fmt.Errorf("failed to encode record: %w", err)
+		}
+		raw = quoted
+	}
+	return putDeadLetterData("", "", value, raw, cause)
+}
+
+func putDeadLetterData(eventID, eventType string, key []byte, raw json.RawMessage, cause error) error {
+	now := time.Now()
+	sum := sha256.Sum256(key)
+	return deadLetters.put(DeadLetter{
+		ID:        fmt.Sprintf("%d-%s", now.UnixNano(), hex.EncodeToString(sum[:4])),
+		EventID:   eventID,
+		EventType: eventType,
+		Event:     raw,
+		Error:     cause.Error(),
+		FailedAt:  now.Unix(),
+	})
+}
+
+// newDeadLetterStore creates the store configured in the environment, the
+// directory taking precedence over the table.
+func newDeadLetterStore(dir, table string) (deadLetterStore, error) {
+	switch {
+	case dir != "":
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create dead-letter directory: %w", err)
+		}
+		return &dirDeadLetters{dir: dir}, nil
+	case table != "":
+		return &tableDeadLetters{client: dbClient, table: table}, nil
+	}
+	return nil, nil
+}
+
+// dirDeadLetters keeps each dead letter as a JSON file in dir.
+type dirDeadLetters struct {
+	dir string
+}
+
+func (s *dirDeadLetters) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("invalid dead letter ID %q", id)
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+func (s *dirDeadLetters) put(letter DeadLetter) error {
+	path, err := s.path(letter.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(path, data)
+}
+
+func (s *dirDeadLetters) list() ([]DeadLetter, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, 0, len(entries))
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		letter, err := s.get(id)
+		if err != nil {
+			log.Printf("skipping dead letter %s: %v", entry.Name(), err)
+			continue
+		}
+		if letter != nil {
+			letters = append(letters, *letter)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].ID < letters[j].ID })
+	return letters, nil
+}
+
+func (s *dirDeadLetters) get(id string) (*DeadLetter, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var letter DeadLetter
+	if err := json.Unmarshal(data, &letter); err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+func (s *dirDeadLetters) remove(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// tableDeadLetters keeps dead letters in a DynamoDB table whose partition
+// key is the string attribute id.
+type tableDeadLetters struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func (s *tableDeadLetters) key(id string) (DynoNotation, error) {
+	return attributevalue.MarshalMap(map[string]string{"id": id})
+}
+
+func (s *tableDeadLetters) put(letter DeadLetter) error {
+	item, err := attributevalue.MarshalMap(letter)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+	return putItem(s.client, s.table, item)
+}
+
+func (s *tableDeadLetters) list() ([]DeadLetter, error) {
+	var letters []DeadLetter
+	paginator := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{TableName: aws.String(s.table)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		var items []DeadLetter
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal dead letters: %w", err)
+		}
+		letters = append(letters, items...)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].ID < letters[j].ID })
+	return letters, nil
+}
+
+func (s *tableDeadLetters) get(id string) (*DeadLetter, error) {
+	key, err := s.key(id)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(s.table), Key: key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Item == nil {
+		return nil, nil
+	}
+	var letter DeadLetter
+	if err := attributevalue.UnmarshalMap(resp.Item, &letter); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dead letter: %w", err)
+	}
+	return &letter, nil
+}
+
+func (s *tableDeadLetters) remove(id string) error {
+	key, err := s.key(id)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table), Key: key,
+	})
+	return err
+}
+
+// deadLetterHandler serves the dead letters under prefix:
+//
+//	GET    {prefix}               lists the dead letters
+//	GET    {prefix}/{id}          returns a dead letter
+//	POST   {prefix}/{id}/retry    processes the event again, removing the letter on success
+//	DELETE {prefix}/{id}          removes a dead letter
+type deadLetterHandler struct {
+	prefix string
+	store  deadLetterStore
+	// token must be sent as a bearer token, every request is refused when
+	// it is empty
+	token []byte
+}
+
+func (h *deadLetterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if len(h.token) == 0 || subtle.ConstantTimeCompare(h.token, []byte(token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, h.prefix), "/")
+	id, action, _ := strings.Cut(rest, "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		letters, err := h.store.list()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, letters)
+	case id != "" && action == "" && r.Method == http.MethodGet:
+		letter, ok := h.lookup(w, id)
+		if ok {
+			writeJSON(w, letter)
+		}
+	case id != "" && action == "" && r.Method == http.MethodDelete:
+		if _, ok := h.lookup(w, id); !ok {
+			return
+		}
+		if err := h.store.remove(id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case id != "" && action == "retry" && r.Method == http.MethodPost:
+		letter, ok := h.lookup(w, id)
+		if ok {
+			h.retry(w, r.Context(), letter)
+		}
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// lookup returns the dead letter with the ID, writing an error response
+// when there is none.
+func (h *deadLetterHandler) lookup(w http.ResponseWriter, id string) (*DeadLetter, bool) {
+	letter, err := h.store.get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if letter == nil {
+		http.Error(w, "dead letter not found", http.StatusNotFound)
+		return nil, false
+	}
+	return letter, true
+}
+
+// retry processes the event of the letter again. The letter is removed
+// when it succeeds and kept when it fails.
+func (h *deadLetterHandler) retry(w http.ResponseWriter, ctx context.Context, letter *DeadLetter) {
+	event := cloudevents.NewEvent()
+	if err := json.Unmarshal(letter.Event, &event); err != nil {
+		http.Error(w, "failed to decode event: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	eventType, outcome, err := processEvent(ctx, event)
+	eventsProcessed.WithLabelValues(eventType, outcome).Inc()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := h.store.remove(letter.ID); err != nil {
+		log.Printf("failed to remove retried dead letter %s: %v", letter.ID, err)
+	}
+	writeJSON(w, map[string]string{"id": letter.ID, "outcome": outcome})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+// processedEvents remembers recently processed keys, evicting the least
+// recently used one once it holds size keys.
+type processedEvents struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+// processed holds the keys of the events handled by this replica. The
+// DynamoDB markers cover events already handled by other replicas or before
+// a restart.
+var processed = newProcessedEvents(4096)
+
+func newProcessedEvents(size int) *processedEvents {
+	return &processedEvents{
+		size:  size,
+		order: list.New(),
+		keys:  make(map[string]*list.Element),
+	}
+}
+
+func (p *processedEvents) contains(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elem, ok := p.keys[key]
+	if ok {
+		p.order.MoveToFront(elem)
+	}
+	return ok
+}
+
+func (p *processedEvents) add(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.keys[key]; ok {
+		p.order.MoveToFront(elem)
+		return
+	}
+	p.keys[key] = p.order.PushFront(key)
+	if p.order.Len() > p.size {
+		oldest := p.order.Back()
+		p.order.Remove(oldest)
+		delete(p.keys, oldest.Value.(string))
+	}
+}
+
+// eventKey identifies a CloudEvent, which is unique by source and ID.
+func eventKey(event cloudevents.Event) string {
+	return event.Source() + "/" + event.ID()
+}
+
+// pipelineRunKey identifies a PipelineRun that was stored in its final
+// state.
+func pipelineRunKey(uid string) string {
+	return "pipelinerun/" + uid
+}
+
+// eventLease is how long a claim on an event holds. A replica that dies
+// while handling an event leaves a claim that others may take over once it
+// has expired.
+const eventLease = 5 * time.Minute
+
+// claimEvent claims the event for this replica. It reports false when the
+// event was already processed or is being processed elsewhere.
+func claimEvent(event cloudevents.Event) (bool, error) {
+	key := eventKey(event)
+	if processed.contains(key) {
+		return false, nil
+	}
+	claimed, err := claimEventMarker(dbClient, "TektonCI", key, eventLease)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim marker of event %s: %w", event.ID(), err)
+	}
+	return claimed, nil
+}
+
+// completeEvent records that the claimed event was handled.
+func completeEvent(event cloudevents.Event) {
+	key := eventKey(event)
+	processed.add(key)
+	if err := completeEventMarker(dbClient, "TektonCI", key); err != nil {
+		log.Printf("failed to store marker of event %s: %v", event.ID(), err)
+	}
+}
+
+// releaseEvent gives up the claim on an event whose processing failed, so
+// that it is processed again when it is redelivered. A claim that cannot
+// be released expires with its lease.
+func releaseEvent(event cloudevents.Event) {
+	if err := releaseEventMarker(dbClient, "TektonCI", eventKey(event)); err != nil {
+		log.Printf("failed to release marker of event %s: %v", event.ID(), err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testEventType = "dev.example.test"
+
+// useFakeStore points the handlers at a fake DynamoDB and an empty cache of
+// processed events.
+func useFakeStore(t *testing.T) *fakeDynamoDB {
+	t.Helper()
+	client, fake := newFakeDynamoDB(t)
+	previousClient, previousProcessed := dbClient, processed
+	dbClient, processed = client, newProcessedEvents(16)
+	t.Cleanup(func() { dbClient, processed = previousClient, previousProcessed })
+	return fake
+}
+
+func TestProcessEventClaims(t *testing.T) {
+	fake := useFakeStore(t)
+	var calls int
+	var fail error
+	eventHandlers[testEventType] = func(ctx context.Context, event cloudevents.Event) (string, error) {
+		calls++
+		if fail != nil {
+			return "", fail
+		}
+		return outcomeStored, nil
+	}
+	t.Cleanup(func() { delete(eventHandlers, testEventType) })
+
+	steps := []struct {
+		name    string
+		id      string
+		fail    error
+		forget  bool
+		outcome string
+		calls   int
+	}{
+		{name: "new event", id: "1", outcome: outcomeStored, calls: 1},
+		{name: "duplicate in this replica", id: "1", outcome: outcomeDuplicate},
+		{name: "duplicate from another replica", id: "1", forget: true, outcome: outcomeDuplicate},
+		{name: "failure", id: "2", fail: errors.New("store unavailable"), outcome: outcomeFailed, calls: 1},
+		{name: "redelivery after a failure", id: "2", outcome: outcomeStored, calls: 1},
+		{name: "duplicate of the redelivery", id: "2", forget: true, outcome: outcomeDuplicate},
+	}
+	for _, step := range steps {
+		calls, fail = 0, step.fail
+		if step.forget {
+			processed = newProcessedEvents(16)
+		}
+		_, outcome, err := processEvent(context.Background(), testEvent(step.id, testEventType))
+		if (err != nil) != (step.fail != nil) {
+			t.Errorf("%s: error = %v", step.name, err)
+		}
+		if outcome != step.outcome || calls != step.calls {
+			t.Errorf("%s: outcome %s after %d calls, want %s after %d", step.name, outcome, calls, step.outcome, step.calls)
+		}
+	}
+	marker := fake.get("TektonCI", eventMarkerOrigin, eventKey(testEvent("2", testEventType)))
+	if marker == nil || fake.value(marker["state"]) != eventMarkerDone {
+		t.Errorf("marker of the redelivered event = %s, want it done", marker)
+	}
+}
+
+func TestProcessEventTakesOverExpiredClaim(t *testing.T) {
+	useFakeStore(t)
+	eventHandlers[testEventType] = func(ctx context.Context, event cloudevents.Event) (string, error) {
+		return outcomeStored, nil
+	}
+	t.Cleanup(func() { delete(eventHandlers, testEventType) })
+	event := testEvent("1", testEventType)
+
+	// another replica holds the claim
+	if claimed, err := claimEventMarker(dbClient, "TektonCI", eventKey(event), eventLease); err != nil || !claimed {
+		t.Fatalf("claimEventMarker = %v, %v", claimed, err)
+	}
+	if _, outcome, _ := processEvent(context.Background(), event); outcome != outcomeDuplicate {
+		t.Errorf("outcome = %s while another replica holds the claim, want %s", outcome, outcomeDuplicate)
+	}
+
+	// and died, leaving a claim whose lease lapsed
+	if err := releaseEventMarker(dbClient, "TektonCI", eventKey(event)); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := claimEventMarker(dbClient, "TektonCI", eventKey(event), -eventLease); err != nil || !claimed {
+		t.Fatalf("claimEventMarker = %v, %v", claimed, err)
+	}
+	if _, outcome, err := processEvent(context.Background(), event); err != nil || outcome != outcomeStored {
+		t.Errorf("outcome = %s, %v after the lease expired, want %s", outcome, err, outcomeStored)
+	}
+}
+
+func TestPipelineRunTerminalSkipsCompletedBuild(t *testing.T) {
+	useFakeStore(t)
+	completed := CiBuildPayload{Origin: "Tekton", OriginalID: "uid-1", Name: "build", CompletedAt: 1714557600}
+	if err := storeBuild(dbClient, "TektonCI", completed); err != nil {
+		t.Fatal(err)
+	}
+	event := testEvent("1", pipelineRunSuccessfulEvent)
+	pr := v1.PipelineRun{ObjectMeta: metav1.ObjectMeta{Name: "build", Namespace: "ci", UID: "uid-1"}}
+	if err := event.SetData(cloudevents.ApplicationJSON, Data{Pipelinerun: pr}); err != nil {
+		t.Fatal(err)
+	}
+	// storing the run again would need the cluster to fetch its TaskRuns
+	outcome, err := handlePipelineRunTerminal(context.Background(), event)
+	if err != nil || outcome != outcomeIgnored {
+		t.Fatalf("outcome = %s, %v, want %s", outcome, err, outcomeIgnored)
+	}
+	if !processed.contains(pipelineRunKey("uid-1")) {
+		t.Error("the completed PipelineRun was not remembered")
+	}
+	build, err := getBuild(dbClient, "TektonCI", "Tekton", "uid-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.CompletedAt != completed.CompletedAt {
+		t.Errorf("stored build = %+v, want it unchanged", build)
+	}
+}
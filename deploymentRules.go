@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// deploymentRules classify Tekton runs as deployments. When none are
+// configured no run counts as a deployment.
+var deploymentRules []deploymentRule
+
+// Params conventionally naming the namespace a run deploys to, in order of
+// preference. A bare namespace param is left out, many Tasks take one for
+// the namespace they read from.
+var targetNamespaceParams = []string{"target-namespace", "deploy-namespace"}
+
+// deploymentRule marks the runs it matches as deployments. On top of the
+// conditions of runRule, which match the run itself, it can require the
+// run to use certain Tasks and to deploy to certain namespaces:
+//
+//   - name: argocd-sync
+//     tasks: ["argocd-task-sync-and-wait"]
+//   - name: prod-deploy
+//     selector: "app.kubernetes.io/component=deploy"
+//     targetNamespaces: ["prod-*"]
+type deploymentRule struct {
+	// Name is recorded on the builds the rule matches
+	Name string `json:"name"`
+	runRule
+	// Tasks lists Task names, the run must use at least one of them
+	Tasks []string `json:"tasks"`
+	// TargetNamespaces are path.Match patterns matched against the
+	// target-namespace or deploy-namespace param of the run, or its own
+	// namespace when it has neither
+	TargetNamespaces []string `json:"targetNamespaces"`
+}
+
+// loadDeploymentRules reads and compiles the rules in file. A file without
+// rules is rejected, it is most likely a mistake.
+func loadDeploymentRules(file string) ([]deploymentRule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deployment rules: %w", err)
+	}
+	var rules []deploymentRule
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse deployment rules: %w", err)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no deployment rules in %s", file)
+	}
+	for i := range rules {
+		if rules[i].Name == "" {
+			return nil, fmt.Errorf("deployment rule %d has no name", i)
+		}
+		if err := rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("deployment rule %s: %w", rules[i].Name, err)
+		}
+		for _, pattern := range rules[i].TargetNamespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("deployment rule %s: invalid target namespace pattern %q: %w", rules[i].Name, pattern, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// deploymentRun is what the rules know about a run.
+type deploymentRun struct {
+	meta            metav1.ObjectMeta
+	pipelineName    string
+	tasks           []string
+	targetNamespace string
+}
+
+func (r *deploymentRule) matches(run deploymentRun) bool {
+	if !r.runRule.matches(run.meta, run.pipelineName) {
+		return false
+	}
+	if len(r.Tasks) > 0 && !containsAny(run.tasks, r.Tasks) {
+		return false
+	}
+	if len(r.TargetNamespaces) > 0 {
+		matched := false
+		for _, pattern := range r.TargetNamespaces {
+			if ok, _ := path.Match(pattern, run.targetNamespace); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// classifyDeployment reports whether the run is a deployment and the name
+// of the rule that decided it.
+func classifyDeployment(run deploymentRun) (bool, string) {
+	for i := range deploymentRules {
+		if deploymentRules[i].matches(run) {
+			return true, deploymentRules[i].Name
+		}
+	}
+	return false, ""
+}
+
+// classifyPipelineRun classifies the PipelineRun by its Pipeline and the
+// Tasks of its resolved Pipeline spec.
+func classifyPipelineRun(obj v1.PipelineRun) (bool, string) {
+	spec := obj.Status.PipelineSpec
+	if spec == nil {
+		spec = obj.Spec.PipelineSpec
+	}
+	var tasks []string
+	if spec != nil {
+		for _, list := range [][]v1.PipelineTask{spec.Tasks, spec.Finally} {
+			for _, task := range list {
+				tasks = append(tasks, taskRefName(task.TaskRef)...)
+			}
+		}
+	}
+	return classifyDeployment(deploymentRun{
+		meta:            obj.ObjectMeta,
+		pipelineName:    pipelineName(obj),
+		tasks:           tasks,
+		targetNamespace: targetNamespace(obj.Namespace, obj.Spec.Params),
+	})
+}
+
+// classifyTaskRun classifies a standalone TaskRun, whose Task stands in
+// for the Pipeline.
+func classifyTaskRun(obj v1.TaskRun) (bool, string) {
+	tasks := taskRefName(obj.Spec.TaskRef)
+	name := ""
+	if len(tasks) > 0 {
+		name = tasks[0]
+	}
+	return classifyDeployment(deploymentRun{
+		meta:            obj.ObjectMeta,
+		pipelineName:    name,
+		tasks:           tasks,
+		targetNamespace: targetNamespace(obj.Namespace, obj.Spec.Params),
+	})
+}
+
+// taskRefName returns the name of the referenced Task, which resolvers
+// such as the bundles and hub resolvers take as their name param.
+func taskRefName(ref *v1.TaskRef) []string {
+	if ref == nil {
+		return nil
+	}
+	if ref.Name != "" {
+		return []string{ref.Name}
+	}
+	if name := paramValue(ref.Params, []string{"name"}); name != "" {
+		return []string{name}
+	}
+	return nil
+}
+
+// targetNamespace returns the namespace a run deploys to.
+func targetNamespace(namespace string, params v1.Params) string {
+	if target := paramValue(params, targetNamespaceParams); target != "" {
+		return target
+	}
+	return namespace
+}
+
+func containsAny(values, wanted []string) bool {
+	for _, value := range values {
+		for _, w := range wanted {
+			if value == w {
+				return true
+			}
+		}
+	}
+	return false
+}
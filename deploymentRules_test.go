@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testDeploymentRules = `
+- name: argocd-sync
+  tasks: ["argocd-task-sync-and-wait"]
+- name: prod-deploy
+  pipeline: "^deploy$"
+  targetNamespaces: ["prod-*"]
+`
+
+// useDeploymentRules installs the rules for the duration of the test.
+func useDeploymentRules(t *testing.T, content string) {
+	t.Helper()
+	rules, err := loadDeploymentRules(writeRules(t, content))
+	if err != nil {
+		t.Fatalf("loadDeploymentRules: %v", err)
+	}
+	deploymentRules = rules
+	t.Cleanup(func() { deploymentRules = nil })
+}
+
+func TestClassifyPipelineRun(t *testing.T) {
+	pipelineRun := func(pipeline string, tasks []string, params ...v1.Param) v1.PipelineRun {
+		pr := v1.PipelineRun{ObjectMeta: metav1.ObjectMeta{Name: "run", Namespace: "ci"}}
+		pr.Spec.PipelineRef = &v1.PipelineRef{Name: pipeline}
+		pr.Spec.Params = params
+		pr.Status.PipelineSpec = &v1.PipelineSpec{}
+		for _, task := range tasks {
+			pr.Status.PipelineSpec.Tasks = append(pr.Status.PipelineSpec.Tasks, v1.PipelineTask{Name: task, TaskRef: &v1.TaskRef{Name: task}})
+		}
+		return pr
+	}
+	target := func(name, namespace string) v1.Param {
+		return v1.Param{Name: name, Value: *v1.NewStructuredValues(namespace)}
+	}
+	tests := []struct {
+		name     string
+		rules    string
+		run      v1.PipelineRun
+		want     bool
+		wantRule string
+	}{
+		{name: "no rules", run: pipelineRun("deploy", []string{"argocd-task-sync-and-wait"})},
+		{name: "task", rules: testDeploymentRules, run: pipelineRun("release", []string{"build", "argocd-task-sync-and-wait"}), want: true, wantRule: "argocd-sync"},
+		{name: "target namespace", rules: testDeploymentRules, run: pipelineRun("deploy", nil, target("target-namespace", "prod-eu")), want: true, wantRule: "prod-deploy"},
+		{name: "other target namespace", rules: testDeploymentRules, run: pipelineRun("deploy", nil, target("deploy-namespace", "staging"))},
+		{name: "bare namespace param", rules: testDeploymentRules, run: pipelineRun("deploy", nil, target("namespace", "prod-eu"))},
+		{name: "other pipeline", rules: testDeploymentRules, run: pipelineRun("build", []string{"build"}, target("target-namespace", "prod-eu"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.rules != "" {
+				useDeploymentRules(t, tt.rules)
+			}
+			got, rule := classifyPipelineRun(tt.run)
+			if got != tt.want || rule != tt.wantRule {
+				t.Errorf("classifyPipelineRun = %v, %q, want %v, %q", got, rule, tt.want, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestLoadDeploymentRulesErrors(t *testing.T) {
+	tests := map[string]string{
+		"empty":            "",
+		"no name":          `[{pipeline: "^deploy$"}]`,
+		"target namespace": `[{name: prod, targetNamespaces: ["prod-["]}]`,
+		"pipeline":         `[{name: prod, pipeline: "(deploy"}]`,
+	}
+	for name, rules := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadDeploymentRules(writeRules(t, rules)); err == nil {
+				t.Error("invalid rules were loaded")
+			}
+		})
+	}
+}
+
+func TestClassifyCDEvents(t *testing.T) {
+	useDeploymentRules(t, testDeploymentRules)
+	fake := useFakeStore(t)
+	deployment := func(originalID string) (bool, string) {
+		t.Helper()
+		build := fake.get("TektonCI", "CDEvents", originalID)
+		if build == nil {
+			t.Fatalf("build %s was not stored", originalID)
+		}
+		isDeployment := build["isDeployment"] != nil && string(build["isDeployment"]) == `{"BOOL":true}`
+		rule := ""
+		if build["deploymentRule"] != nil {
+			rule = fake.value(build["deploymentRule"])
+		}
+		return isDeployment, rule
+	}
+	handle := func(id, kind string, subject map[string]interface{}) {
+		t.Helper()
+		if _, err := handleCDEvent(context.Background(), cdEvent(t, id, kind, subject)); err != nil {
+			t.Fatalf("handleCDEvent %s: %v", id, err)
+		}
+	}
+
+	handle("1", "pipelinerun.started", map[string]interface{}{
+		"id": "build-1", "source": "ci", "content": map[string]interface{}{"pipelineName": "build"},
+	})
+	if got, rule := deployment("build-1"); got {
+		t.Errorf("a build pipelinerun was classified as a deployment by %q", rule)
+	}
+	handle("2", "pipelinerun.finished", map[string]interface{}{
+		"id": "deploy-1", "source": "prod-eu", "content": map[string]interface{}{"pipelineName": "deploy", "outcome": "success"},
+	})
+	if got, rule := deployment("deploy-1"); !got || rule != "prod-deploy" {
+		t.Errorf("deployment = %v, %q, want prod-deploy", got, rule)
+	}
+
+	// a pipelinerun is a deployment once it runs a deployment task
+	handle("3", "pipelinerun.started", map[string]interface{}{
+		"id": "release-1", "source": "ci", "content": map[string]interface{}{"pipelineName": "release"},
+	})
+	handle("4", "taskrun.started", map[string]interface{}{
+		"id": "release-1-sync", "source": "ci", "content": map[string]interface{}{
+			"taskName": "argocd-task-sync-and-wait", "pipelineRun": map[string]interface{}{"id": "release-1", "source": "ci"},
+		},
+	})
+	if got, rule := deployment("release-1"); !got || rule != "argocd-sync" {
+		t.Errorf("deployment = %v, %q, want argocd-sync", got, rule)
+	}
+
+	// services report deployments themselves
+	for i, kind := range []string{"service.deployed", "service.upgraded"} {
+		id := []string{"5", "6"}[i]
+		handle(id, kind, map[string]interface{}{
+			"id": "api", "source": "argocd", "content": map[string]interface{}{"environment": map[string]interface{}{"id": "staging"}},
+		})
+		if got, _ := deployment(id); !got {
+			t.Errorf("%s was not recorded as a deployment", kind)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+)
+
+// eventSignatureHeader carries the HMAC-SHA256 of the request body, in the
+// form sha256=<hex>.
+const eventSignatureHeader = "X-Event-Signature"
+
+// eventAuth authenticates CloudEvents. Requests must carry a valid HMAC
+// signature or bearer token when either is configured, and events must
+// come from an allowed source when an allowlist is configured.
+type eventAuth struct {
+	hmacSecret []byte
+	tokens     [][]byte
+	// sources are path.Match patterns of the allowed event sources
+	sources []string
+}
+
+// newEventAuth creates the authenticator, reading the bearer tokens, one
+// per line, from tokensFile when it is set.
+func newEventAuth(hmacSecret, tokensFile string, sources []string) (*eventAuth, error) {
+	a := &eventAuth{hmacSecret: []byte(hmacSecret), sources: sources}
+	if tokensFile != "" {
+		data, err := os.ReadFile(tokensFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bearer tokens: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if token := strings.TrimSpace(line); token != "" {
+				a.tokens = append(a.tokens, []byte(token))
+			}
+		}
+		if len(a.tokens) == 0 {
+			return nil, fmt.Errorf("no bearer tokens found in %s", tokensFile)
+		}
+	}
+	for _, pattern := range sources {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid source pattern %q: %w", pattern, err)
+		}
+	}
+	return a, nil
+}
+
+// requiresCredentials reports whether HTTP requests must be signed or carry
+// a token.
+func (a *eventAuth) requiresCredentials() bool {
+	return len(a.hmacSecret) > 0 || len(a.tokens) > 0
+}
+
+// middleware checks the credentials of HTTP requests, rejecting
+// unauthenticated requests before any of their events is decoded.
+func (a *eventAuth) middleware(next http.Handler) http.Handler {
+	if !a.requiresCredentials() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only signatures need the body, other requests are checked
+		// before any of it is read
+		var body []byte
+		if a.signed(r.Header) {
+			var ok bool
+			if body, ok = readBody(w, r); !ok {
+				return
+			}
+		}
+		if rejection := a.checkRequest(r.Header, body); rejection != "" {
+			eventsRejected.WithLabelValues(rejection).Inc()
+			log.Printf("rejected request from %s: %s", r.RemoteAddr, rejection)
+			http.Error(w, "request not authenticated: "+rejection, http.StatusUnauthorized)
+			return
+		}
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		} else {
+			r.Body = http.MaxBytesReader(w, r.Body, maxWebhookBodySize)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// signed reports whether the request is authenticated by its signature,
+// which is checked when it carries no bearer token.
+func (a *eventAuth) signed(header http.Header) bool {
+	return !strings.HasPrefix(header.Get("Authorization"), "Bearer ") &&
+		header.Get(eventSignatureHeader) != "" && len(a.hmacSecret) > 0
+}
+
+// checkRequest returns why the request is not authenticated, or an empty
+// string when it carries a valid token or signature.
+func (a *eventAuth) checkRequest(header http.Header, body []byte) string {
+	if token, ok := strings.CutPrefix(header.Get("Authorization"), "Bearer "); ok {
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare(t, []byte(token)) == 1 {
+				return ""
+			}
+		}
+		return "token"
+	}
+	if signature := header.Get(eventSignatureHeader); signature != "" && len(a.hmacSecret) > 0 {
+		mac := hmac.New(sha256.New, a.hmacSecret)
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if hmac.Equal([]byte(expected), []byte(signature)) {
+			return ""
+		}
+		return "signature"
+	}
+	return "missing_credentials"
+}
+
+// sourceAllowed reports whether events from source are accepted.
+func (a *eventAuth) sourceAllowed(source string) bool {
+	if len(a.sources) == 0 {
+		return true
+	}
+	for _, pattern := range a.sources {
+		if ok, _ := path.Match(pattern, source); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// receiver wraps fn, rejecting events from sources that are not allowed
+// with a NACK that the HTTP transport returns as the response status.
+func (a *eventAuth) receiver(fn receiverFunc) receiverFunc {
+	return func(ctx context.Context, event cloudevents.Event) error {
+		if !a.sourceAllowed(event.Source()) {
+			eventsRejected.WithLabelValues("source").Inc()
+			log.Printf("rejected event %s from %s: source not allowed", event.ID(), event.Source())
+			return cehttp.NewResult(http.StatusForbidden, "source %q is not allowed", event.Source())
+		}
+		return fn(ctx, event)
+	}
+}
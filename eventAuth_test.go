@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func writeTokens(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestNewEventAuth(t *testing.T) {
+	auth, err := newEventAuth("", writeTokens(t, "first\n\n  second  \n"), nil)
+	if err != nil {
+		t.Fatalf("newEventAuth: %v", err)
+	}
+	if len(auth.tokens) != 2 || string(auth.tokens[0]) != "first" || string(auth.tokens[1]) != "second" {
+		t.Errorf("tokens = %q, want first and second", auth.tokens)
+	}
+	if _, err := newEventAuth("", writeTokens(t, "\n \n"), nil); err == nil {
+		t.Error("a tokens file without tokens was accepted")
+	}
+	if _, err := newEventAuth("", filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Error("a missing tokens file was accepted")
+	}
+	if _, err := newEventAuth("", "", []string{"[tekton"}); err == nil {
+		t.Error("an invalid source pattern was accepted")
+	}
+}
+
+func TestCheckRequest(t *testing.T) {
+	auth, err := newEventAuth("secret", writeTokens(t, "token-1\ntoken-2\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"id": "1"}`)
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   string
+	}{
+		{name: "token", header: map[string]string{"Authorization": "Bearer token-2"}},
+		{name: "wrong token", header: map[string]string{"Authorization": "Bearer token-3"}, want: "token"},
+		{name: "signature", header: map[string]string{eventSignatureHeader: sign("secret", body)}},
+		{name: "wrong secret", header: map[string]string{eventSignatureHeader: sign("other", body)}, want: "signature"},
+		{name: "other body", header: map[string]string{eventSignatureHeader: sign("secret", []byte("{}"))}, want: "signature"},
+		{
+			name:   "wrong token with valid signature",
+			header: map[string]string{"Authorization": "Bearer token-3", eventSignatureHeader: sign("secret", body)},
+			want:   "token",
+		},
+		{name: "basic auth", header: map[string]string{"Authorization": "Basic dG9rZW4tMQ=="}, want: "missing_credentials"},
+		{name: "none", want: "missing_credentials"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for k, v := range tt.header {
+				header.Set(k, v)
+			}
+			if got := auth.checkRequest(header, body); got != tt.want {
+				t.Errorf("checkRequest = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// signatures are not checked without a secret
+	tokensOnly := &eventAuth{tokens: auth.tokens}
+	header := http.Header{}
+	header.Set(eventSignatureHeader, sign("", body))
+	if got := tokensOnly.checkRequest(header, body); got != "missing_credentials" {
+		t.Errorf("checkRequest without secret = %q, want missing_credentials", got)
+	}
+}
+
+// unreadBody fails the test when the handler reads it.
+type unreadBody struct {
+	t *testing.T
+}
+
+func (b unreadBody) Read(p []byte) (int, error) {
+	b.t.Error("the body of an unauthenticated request was read")
+	return 0, io.EOF
+}
+
+func TestEventAuthMiddleware(t *testing.T) {
+	auth, err := newEventAuth("secret", writeTokens(t, "token-1\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []byte
+	handler := auth.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if received, err = io.ReadAll(r.Body); err != nil {
+			t.Errorf("failed to read body: %v", err)
+		}
+	}))
+	body := []byte(`{"id": "1"}`)
+	large := bytes.Repeat([]byte("x"), maxWebhookBodySize+1)
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		body   io.Reader
+		status int
+	}{
+		{name: "token", header: map[string]string{"Authorization": "Bearer token-1"}, body: bytes.NewReader(body), status: http.StatusOK},
+		{name: "signature", header: map[string]string{eventSignatureHeader: sign("secret", body)}, body: bytes.NewReader(body), status: http.StatusOK},
+		{name: "wrong signature", header: map[string]string{eventSignatureHeader: sign("other", body)}, body: bytes.NewReader(body), status: http.StatusUnauthorized},
+		{name: "wrong token", header: map[string]string{"Authorization": "Bearer token-2"}, body: unreadBody{t}, status: http.StatusUnauthorized},
+		{name: "no credentials", body: unreadBody{t}, status: http.StatusUnauthorized},
+		{name: "signed body too large", header: map[string]string{eventSignatureHeader: sign("secret", large)}, body: bytes.NewReader(large), status: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = nil
+			r := httptest.NewRequest(http.MethodPost, "/", tt.body)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && !bytes.Equal(received, body) {
+				t.Errorf("handler received %q, want %q", received, body)
+			} else if tt.status != http.StatusOK && received != nil {
+				t.Error("a rejected request reached the handler")
+			}
+		})
+	}
+}
+
+func TestEventAuthSourceAllowlist(t *testing.T) {
+	mux := http.NewServeMux()
+	auth := &eventAuth{sources: []string{"/tekton/*", "jenkins"}}
+	var handled []string
+	transport := &httpTransport{mux: mux, path: "/", auth: auth}
+	err := transport.start(context.Background(), func(ctx context.Context, event cloudevents.Event) error {
+		handled = append(handled, event.Source())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		source string
+		status int
+	}{
+		{source: "/tekton/ci", status: http.StatusOK},
+		{source: "jenkins", status: http.StatusOK},
+		{source: "/tekton", status: http.StatusForbidden},
+		{source: "/tekton/ci/nested", status: http.StatusForbidden},
+		{source: "github", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))
+			r.Header.Set("Ce-Specversion", "1.0")
+			r.Header.Set("Ce-Id", "1")
+			r.Header.Set("Ce-Type", pipelineRunSuccessfulEvent)
+			r.Header.Set("Ce-Source", tt.source)
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+	if got := strings.Join(handled, ","); got != "/tekton/ci,jenkins" {
+		t.Errorf("handled events from %s, want only the allowed sources", got)
+	}
+}
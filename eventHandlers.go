@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+)
+
+// CloudEvent types emitted by the Tekton pipelines controller.
+const (
+	pipelineRunStartedEvent    = "dev.tekton.event.pipelinerun.started.v1"
+	pipelineRunRunningEvent    = "dev.tekton.event.pipelinerun.running.v1"
+	pipelineRunUnknownEvent    = "dev.tekton.event.pipelinerun.unknown.v1"
+	pipelineRunSuccessfulEvent = "dev.tekton.event.pipelinerun.successful.v1"
+	pipelineRunFailedEvent     = "dev.tekton.event.pipelinerun.failed.v1"
+	taskRunStartedEvent        = "dev.tekton.event.taskrun.started.v1"
+	taskRunRunningEvent        = "dev.tekton.event.taskrun.running.v1"
+	taskRunUnknownEvent        = "dev.tekton.event.taskrun.unknown.v1"
+	taskRunSuccessfulEvent     = "dev.tekton.event.taskrun.successful.v1"
+	taskRunFailedEvent         = "dev.tekton.event.taskrun.failed.v1"
+)
+
+// Types of the CloudEvents that webhooks are turned into, so that they are
+// queued, deduplicated and dead-lettered like CloudEvents received
+// directly. The handlers are registered along with the webhook endpoints.
+const (
+	githubWorkflowRunEvent = "github.workflow_run"
+	githubWorkflowJobEvent = "github.workflow_job"
+	gitlabPipelineEvent    = "gitlab.pipeline"
+	gitlabJobEvent         = "gitlab.job"
+	jenkinsBuildEvent      = "jenkins.build"
+	// jenkinsStagesEvent asks for the stages of a completed Jenkins build
+	// to be fetched, it is queued by the jenkinsBuildEvent handler
+	jenkinsStagesEvent = "jenkins.stages"
+)
+
+// Outcomes recorded against the processed events counter.
+const (
+	outcomeStored  = "stored"
+	outcomeIgnored = "ignored"
+	outcomeFailed  = "failed"
+	// outcomeDuplicate counts redeliveries of events already processed
+	outcomeDuplicate = "duplicate"
+	// outcomeDeadLettered counts events moved to the dead-letter store
+	outcomeDeadLettered = "dead_lettered"
+)
+
+// buildMu serialises the read-modify-write of builds assembled from
+// several webhooks, such as the run and job webhooks of the same run.
+var buildMu sync.Mutex
+
+// eventHandler processes a single CloudEvent and reports what happened to it.
+type eventHandler func(ctx context.Context, event cloudevents.Event) (string, error)
+
+// eventHandlers routes each known CloudEvent type to its handler. Types
+// missing from this map are acknowledged by handleUnknownEvent. Webhook
+// handlers add their types at start.
+var eventHandlers = map[string]eventHandler{
+	pipelineRunStartedEvent:    handlePipelineRunStarted,
+	pipelineRunRunningEvent:    handlePipelineRunRunning,
+	pipelineRunUnknownEvent:    handlePipelineRunRunning,
+	pipelineRunSuccessfulEvent: handlePipelineRunTerminal,
+	pipelineRunFailedEvent:     handlePipelineRunTerminal,
+	taskRunStartedEvent:        handleTaskRunInProgress,
+	taskRunRunningEvent:        handleTaskRunInProgress,
+	taskRunUnknownEvent:        handleTaskRunInProgress,
+	taskRunSuccessfulEvent:     handleTaskRunTerminal,
+	taskRunFailedEvent:         handleTaskRunTerminal,
+}
+
+// dispatchEvent processes the event and counts the outcome. Events that
+// cannot be converted are moved to the dead-letter store when one is
+// configured, since redelivering them would fail the same way.
+func dispatchEvent(ctx context.Context, event cloudevents.Event) error {
+	eventType, outcome, err := processEvent(ctx, event)
+	var convErr *conversionError
+	if errors.As(err, &convErr) && deadLetters != nil {
+		if dlErr := putDeadLetter(event, err); dlErr != nil {
+			log.Printf("failed to dead-letter event %s: %v", event.ID(), dlErr)
+		} else {
+			outcome, err = outcomeDeadLettered, nil
+		}
+	}
+	eventsProcessed.WithLabelValues(eventType, outcome).Inc()
+	return err
+}
+
+// processEvent looks up the handler for the event type and runs it,
+// returning the type and outcome the event is counted under. Events are
+// claimed before they are handled, so that an event already processed or
+// being processed, here or by another replica, is skipped. Events without
+// a handler are not claimed since ignoring them twice does no harm.
+func processEvent(ctx context.Context, event cloudevents.Event) (string, string, error) {
+	eventType := event.Type()
+	handler, ok := eventHandlers[eventType]
+	switch {
+	case ok:
+	case strings.HasPrefix(eventType, cdEventPrefix):
+		handler = handleCDEvent
+		eventType = cdEventMetricType(eventType)
+	default:
+		handler = handleUnknownEvent
+		eventType = "unknown"
+	}
+	if eventType == "unknown" || eventType == cdEventPrefix+"unknown" {
+		outcome, err := handleUnknownEvent(ctx, event)
+		return eventType, outcome, err
+	}
+	claimed, err := claimEvent(event)
+	if err != nil {
+		log.Printf("failed to claim event %s of type %s: %v", event.ID(), event.Type(), err)
+		return eventType, outcomeFailed, err
+	}
+	if !claimed {
+		return eventType, outcomeDuplicate, nil
+	}
+	outcome, err := handler(ctx, event)
+	if err != nil {
+		outcome = outcomeFailed
+		log.Printf("failed to process event %s of type %s: %v", event.ID(), event.Type(), err)
+		releaseEvent(event)
+	} else {
+		completeEvent(event)
+	}
+	return eventType, outcome, err
+}
+
+// conversionError marks failures to turn an event into a build. They fail
+// again however often the event is retried.
+type conversionError struct {
+	err error
+}
+
+func (e *conversionError) Error() string { return e.err.Error() }
+
+func (e *conversionError) Unwrap() error { return e.err }
+
+// isPermanent reports whether retrying the event cannot help: it cannot be
+// converted, or it was rejected.
+func isPermanent(err error) bool {
+	var convErr *conversionError
+	var result *cehttp.Result
+	return errors.As(err, &convErr) ||
+		errors.As(err, &result) && result.StatusCode < http.StatusInternalServerError
+}
+
+// decodeTektonEvent unmarshals the tektonv1 payload carried by the event.
+func decodeTektonEvent(event cloudevents.Event) (Data, error) {
+	var dat Data
+	if err := json.Unmarshal(eventPayload(event), &dat); err != nil {
+		return dat, &conversionError{fmt.Errorf("failed to decode %s payload: %w", event.Type(), err)}
+	}
+	if dat.Pipelinerun.UID == "" && dat.Taskrun.UID == "" {
+		return dat, &conversionError{fmt.Errorf("%s payload carries neither a PipelineRun nor a TaskRun", event.Type())}
+	}
+	return dat, nil
+}
+
+// handlePipelineRunStarted records a freshly started PipelineRun. No
+// TaskRuns exist yet, so the record carries no stages.
+func handlePipelineRunStarted(ctx context.Context, event cloudevents.Event) (string, error) {
+	dat, recorded, err := decodeRecordedPipelineRun(event)
+	if err != nil || !recorded {
+		return outcomeIgnored, err
+	}
+	item := PrepareCiBuildSummary(dat.Pipelinerun)
+	stored, err := putInProgressItem(dbClient, "TektonCI", item)
+	if err != nil || !stored {
+		return outcomeIgnored, err
+	}
+	return outcomeStored, nil
+}
+
+// handlePipelineRunRunning refreshes an in-progress PipelineRun with the
+// TaskRuns created so far.
+func handlePipelineRunRunning(ctx context.Context, event cloudevents.Event) (string, error) {
+	dat, recorded, err := decodeRecordedPipelineRun(event)
+	if err != nil || !recorded {
+		return outcomeIgnored, err
+	}
+	if processed.contains(pipelineRunKey(string(dat.Pipelinerun.UID))) {
+		return outcomeIgnored, nil
+	}
+	item, err := PrepareCiBuildData(kubeClient, dat.Pipelinerun)
+	if err != nil {
+		return "", err
+	}
+	stored, err := putInProgressItem(dbClient, "TektonCI", item)
+	if err != nil || !stored {
+		return outcomeIgnored, err
+	}
+	return outcomeStored, nil
+}
+
+// handlePipelineRunTerminal stores the final state of a successful or
+// failed PipelineRun, overwriting any in-progress record.
+func handlePipelineRunTerminal(ctx context.Context, event cloudevents.Event) (string, error) {
+	dat, recorded, err := decodeRecordedPipelineRun(event)
+	if err != nil || !recorded {
+		return outcomeIgnored, err
+	}
+	// The terminal state of a run is final, fetching its TaskRuns again for
+	// another event of the same run is wasted work
+	key := pipelineRunKey(string(dat.Pipelinerun.UID))
+	if processed.contains(key) {
+		return outcomeIgnored, nil
+	}
+	existing, err := getBuild(dbClient, "TektonCI", "Tekton", string(dat.Pipelinerun.UID))
+	if err != nil {
+		return "", err
+	}
+	if existing != nil && existing.CompletedAt != 0 {
+		processed.add(key)
+		return outcomeIgnored, nil
+	}
+	if err := InsertRecordInDatabase(dat.Pipelinerun, dbClient, kubeClient); err != nil {
+		return "", err
+	}
+	processed.add(key)
+	return outcomeStored, nil
+}
+
+// decodeRecordedPipelineRun decodes a PipelineRun event and reports whether
+// the PipelineRun should be stored. PipelineRuns created by another
+// PipelineRun or a CustomRun are stored as stages of their parent, and
+// PipelineRuns excluded by the recording rules are not stored.
+func decodeRecordedPipelineRun(event cloudevents.Event) (Data, bool, error) {
+	dat, err := decodeTektonEvent(event)
+	if err != nil {
+		return dat, false, err
+	}
+	if isChildPipelineRun(dat.Pipelinerun) {
+		log.Printf("skipping %s event %s for child PipelineRun %s", event.Type(), event.ID(), dat.Pipelinerun.Name)
+		return dat, false, nil
+	}
+	if !recordPipelineRun(dat.Pipelinerun) {
+		return dat, false, nil
+	}
+	return dat, true, nil
+}
+
+// decodeStandaloneTaskRun decodes a TaskRun event and reports whether the
+// TaskRun should be stored on its own. TaskRuns that belong to a
+// PipelineRun are collected when the PipelineRun itself is stored, and
+// TaskRuns excluded by the recording rules are not stored.
+func decodeStandaloneTaskRun(event cloudevents.Event) (Data, bool, error) {
+	dat, err := decodeTektonEvent(event)
+	if err != nil {
+		return dat, false, err
+	}
+	if !isStandaloneTaskRun(dat.Taskrun) {
+		log.Printf("skipping %s event %s for TaskRun %s owned by a PipelineRun", event.Type(), event.ID(), dat.Taskrun.Name)
+		return dat, false, nil
+	}
+	return dat, recordTaskRun(dat.Taskrun), nil
+}
+
+// handleTaskRunInProgress records a standalone TaskRun that has not
+// finished yet.
+func handleTaskRunInProgress(ctx context.Context, event cloudevents.Event) (string, error) {
+	dat, standalone, err := decodeStandaloneTaskRun(event)
+	if err != nil || !standalone {
+		return outcomeIgnored, err
+	}
+	stored, err := putInProgressItem(dbClient, "TektonCI", PrepareTaskRunCiBuildData(dat.Taskrun))
+	if err != nil || !stored {
+		return outcomeIgnored, err
+	}
+	return outcomeStored, nil
+}
+
+// handleTaskRunTerminal stores the final state of a standalone TaskRun.
+func handleTaskRunTerminal(ctx context.Context, event cloudevents.Event) (string, error) {
+	dat, standalone, err := decodeStandaloneTaskRun(event)
+	if err != nil || !standalone {
+		return outcomeIgnored, err
+	}
+	if err := storeBuild(dbClient, "TektonCI", PrepareTaskRunCiBuildData(dat.Taskrun)); err != nil {
+		return "", err
+	}
+	return outcomeStored, nil
+}
+
+// handleUnknownEvent acknowledges events this listener does not understand
+// so that the sender does not keep retrying them.
+func handleUnknownEvent(ctx context.Context, event cloudevents.Event) (string, error) {
+	log.Printf("ignoring event %s with unsupported type %s from %s", event.ID(), event.Type(), event.Source())
+	return outcomeIgnored, nil
+}
+
+// storeBuildState writes a completed build unconditionally and an unfinished
+// one only if it has not completed in the meantime.
+func storeBuildState(payload CiBuildPayload) (string, error) {
+	if payload.CompletedAt != 0 {
+		if err := storeBuild(dbClient, "TektonCI", payload); err != nil {
+			return "", err
+		}
+		return outcomeStored, nil
+	}
+	stored, err := putInProgressItem(dbClient, "TektonCI", payload)
+	if err != nil || !stored {
+		return outcomeIgnored, err
+	}
+	return outcomeStored, nil
+}
+
+// receiveWebhook hands an authenticated webhook body to eventReceiver as a
+// CloudEvent of eventType, identified by the delivery ID or, when the
+// sender sets none, by the body. The webhook is acknowledged once the
+// event is queued or stored.
+func receiveWebhook(w http.ResponseWriter, r *http.Request, eventType, source, id string, body []byte) {
+	if !json.Valid(body) {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if id == "" {
+		sum := sha256.Sum256(body)
+		id = hex.EncodeToString(sum[:])
+	}
+	event := cloudevents.NewEvent()
+	event.SetID(id)
+	event.SetSource(source)
+	event.SetType(eventType)
+	event.SetTime(time.Now())
+	if err := event.SetData(cloudevents.ApplicationJSON, body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := eventReceiver(r.Context(), event); err != nil {
+		log.Printf("failed to receive %s webhook %s: %v", source, id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+// eventQueue is set when QUEUE_DIR is configured. Received events are then
+// acknowledged once persisted to it rather than once stored.
+var eventQueue *walQueue
+
+// walQueue is an on-disk write-ahead queue of CloudEvents. Each event is
+// a file named after its arrival so the directory lists in order, and it is
+// only removed once the event was processed, so events pending at a
+// restart are processed when the listener starts again.
+type walQueue struct {
+	dir string
+
+	mu  sync.Mutex
+	seq uint64
+	// wake is signalled when an event is enqueued
+	wake chan struct{}
+}
+
+// newWALQueue opens the queue in dir, creating the directory if needed.
+func newWALQueue(dir string) (*walQueue, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+	q := &walQueue{dir: dir, wake: make(chan struct{}, 1)}
+	pending, err := q.pending()
+	if err != nil {
+		return nil, err
+	}
+	queueDepth.Set(float64(len(pending)))
+	return q, nil
+}
+
+// enqueue persists the event, returning once it is safely on disk.
+func (q *walQueue) enqueue(event cloudevents.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event %s: %w", event.ID(), err)
+	}
+	q.mu.Lock()
+	q.seq++
+	name := fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), q.seq%1000000)
+	q.mu.Unlock()
+
+	tmp := filepath.Join(q.dir, "."+name+".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to persist event %s: %w", event.ID(), err)
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to persist event %s: %w", event.ID(), err)
+	}
+	if err := syncDir(q.dir); err != nil {
+		return fmt.Errorf("failed to persist event %s: %w", event.ID(), err)
+	}
+	queueDepth.Inc()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pending returns the queued files, oldest first.
+func (q *walQueue) pending() ([]string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".json") && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// maxQueueAttempts is how often a queued event is tried before it is moved
+// to the dead-letter store, when one is configured.
+const maxQueueAttempts = 10
+
+// queueRetry tracks the failures of a queued event.
+type queueRetry struct {
+	attempts int
+	at       time.Time
+}
+
+// drain hands queued events to fn in order until the context is done. An
+// event that fails is retried with its own exponential backoff while the
+// events behind it carry on, so a store outage delays events instead of
+// losing them and one bad event does not hold up the others. Events that
+// keep failing are dead-lettered.
+func (q *walQueue) drain(ctx context.Context, fn receiverFunc) {
+	retries := make(map[string]*queueRetry)
+	for ctx.Err() == nil {
+		names, err := q.pending()
+		if err != nil {
+			log.Printf("failed to list queued events: %v", err)
+		}
+		wait := time.Minute
+		for _, name := range names {
+			if ctx.Err() != nil {
+				return
+			}
+			retry := retries[name]
+			if retry != nil && time.Now().Before(retry.at) {
+				wait = min(wait, time.Until(retry.at))
+				continue
+			}
+			err := q.process(ctx, name, fn)
+			if err == nil {
+				delete(retries, name)
+				continue
+			}
+			if retry == nil {
+				retry = &queueRetry{}
+				retries[name] = retry
+			}
+			retry.attempts++
+			if retry.attempts >= maxQueueAttempts && q.deadLetter(name, err) {
+				delete(retries, name)
+				continue
+			}
+			backoff := min(time.Second<<min(retry.attempts-1, 9), 5*time.Minute)
+			retry.at = time.Now().Add(backoff)
+			wait = min(wait, backoff)
+			log.Printf("failed to process queued event %s, retrying in %s: %v", name, backoff, err)
+		}
+		select {
+		case <-q.wake:
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// deadLetter moves the queued event in name to the dead-letter store. It
+// reports false, leaving the event queued, when there is no store or the
+// event could not be stored.
+func (q *walQueue) deadLetter(name string, cause error) bool {
+	if deadLetters == nil {
+		return false
+	}
+	path := filepath.Join(q.dir, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("failed to read queued event %s: %v", name, err)
+		return false
+	}
+	event := cloudevents.NewEvent()
+	if err := json.Unmarshal(data, &event); err != nil {
+		log.Printf("failed to decode queued event %s: %v", name, err)
+		return false
+	}
+	if err := putDeadLetter(event, cause); err != nil {
+		log.Printf("failed to dead-letter queued event %s: %v", name, err)
+		return false
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("failed to remove dead-lettered event %s: %v", name, err)
+		return true
+	}
+	queueDepth.Dec()
+	return true
+}
+
+// process hands the queued event in name to fn and removes it once fn
+// succeeds.
+func (q *walQueue) process(ctx context.Context, name string, fn receiverFunc) error {
+	path := filepath.Join(q.dir, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	event := cloudevents.NewEvent()
+	if err := json.Unmarshal(data, &event); err != nil {
+		// retrying cannot fix a corrupt file, it is kept as a dead record
+		// when there is a store for it
+		if deadLetters != nil {
+			if dlErr := putDeadRecord(data, err); dlErr != nil {
+				return fmt.Errorf("failed to dead-letter unreadable queued event: %w", dlErr)
+			}
+		}
+		log.Printf("dropping unreadable queued event %s: %v", name, err)
+	} else if err := fn(ctx, event); err != nil {
+		if !isPermanent(err) {
+			return err
+		}
+		log.Printf("dropping queued event %s: %v", name, err)
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	queueDepth.Dec()
+	return nil
+}
+
+// writeFileSync writes data to path and flushes it to disk.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes the directory entries of dir, making renames durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+// failingDeadLetters fails every put.
+type failingDeadLetters struct {
+	dirDeadLetters
+}
+
+func (s *failingDeadLetters) put(letter DeadLetter) error {
+	return errors.New("store unavailable")
+}
+
+func TestQueueProcessUnreadableEvent(t *testing.T) {
+	fn := func(ctx context.Context, event cloudevents.Event) error {
+		t.Errorf("unreadable event %s was handled", event.ID())
+		return nil
+	}
+	tests := []struct {
+		name      string
+		store     deadLetterStore
+		wantErr   bool
+		wantQueue int
+	}{
+		{name: "no store"},
+		{name: "store", store: &dirDeadLetters{dir: t.TempDir()}},
+		{name: "store failing", store: &failingDeadLetters{}, wantErr: true, wantQueue: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deadLetters = tt.store
+			t.Cleanup(func() { deadLetters = nil })
+			queue, err := newWALQueue(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := "00000000000000000001-000001.json"
+			if err := os.WriteFile(filepath.Join(queue.dir, name), []byte(`{"specversion": `), 0o640); err != nil {
+				t.Fatal(err)
+			}
+			if err := queue.process(context.Background(), name, fn); (err != nil) != tt.wantErr {
+				t.Errorf("process error = %v, want error %v", err, tt.wantErr)
+			}
+			pending, err := queue.pending()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pending) != tt.wantQueue {
+				t.Errorf("queue holds %d events, want %d", len(pending), tt.wantQueue)
+			}
+			store, ok := tt.store.(*dirDeadLetters)
+			if !ok {
+				return
+			}
+			letters, err := store.list()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(letters) != 1 || string(letters[0].Event) != `"{\"specversion\": "` || letters[0].Error == "" {
+				t.Errorf("dead letters = %+v, want the unreadable event with its error", letters)
+			}
+		})
+	}
+}
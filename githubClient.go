@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxCachedResponses bounds the number of ETag responses kept in memory.
+const maxCachedResponses = 1000
+
+// githubClient calls the GitHub REST API, reusing responses through ETag
+// conditional requests and waiting out rate limits.
+type githubClient struct {
+	httpClient *http.Client
+	baseURL    string
+	token      string
+
+	mu      sync.Mutex
+	cache   map[string]cachedResponse
+	resetAt time.Time
+}
+
+// cachedResponse is a response body together with the headers needed to
+// revalidate and paginate it.
+type cachedResponse struct {
+	etag string
+	link string
+	body []byte
+}
+
+func newGitHubClient(baseURL, token string) *githubClient {
+	return &githubClient{
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		baseURL:    baseURL,
+		token:      token,
+		cache:      make(map[string]cachedResponse),
+	}
+}
+
+// getJSON fetches url and decodes the body into v. It returns the URL of the
+// next page, or an empty string on the last page.
+func (g *githubClient) getJSON(ctx context.Context, url string, v interface{}) (string, error) {
+	resp, err := g.get(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(resp.body, v); err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", url, err)
+	}
+	return nextPageURL(resp.link), nil
+}
+
+func (g *githubClient) get(ctx context.Context, url string) (cachedResponse, error) {
+	for attempt := 0; ; attempt++ {
+		if err := g.waitForRateLimit(ctx); err != nil {
+			return cachedResponse{}, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return cachedResponse{}, err
+		}
+		req.Header.Add("Accept", "application/vnd.github+json")
+		req.Header.Add("X-GitHub-Api-Version", "2022-11-28")
+		if g.token != "" {
+			req.Header.Add("Authorization", fmt.Sprintf("Bearer %v", g.token))
+		}
+		g.mu.Lock()
+		cached, ok := g.cache[url]
+		g.mu.Unlock()
+		if ok {
+			req.Header.Add("If-None-Match", cached.etag)
+		}
+
+		resp, err := g.httpClient.Do(req)
+		if err != nil {
+			return cachedResponse{}, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return cachedResponse{}, err
+		}
+		g.recordRateLimit(resp.Header)
+
+		switch {
+		case resp.StatusCode == http.StatusNotModified && ok:
+			return cached, nil
+		case resp.StatusCode == http.StatusOK:
+			fresh := cachedResponse{etag: resp.Header.Get("ETag"), link: resp.Header.Get("Link"), body: body}
+			if fresh.etag != "" {
+				g.mu.Lock()
+				if len(g.cache) >= maxCachedResponses {
+					g.cache = make(map[string]cachedResponse)
+				}
+				g.cache[url] = fresh
+				g.mu.Unlock()
+			}
+			return fresh, nil
+		case (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests) && attempt < 3:
+			wait := retryAfter(resp.Header)
+			log.Printf("GitHub rate limited %s, retrying in %s", url, wait)
+			if err := sleepContext(ctx, wait); err != nil {
+				return cachedResponse{}, err
+			}
+		default:
+			return cachedResponse{}, fmt.Errorf("GET %s returned %d: %s", url, resp.StatusCode, body)
+		}
+	}
+}
+
+// recordRateLimit remembers when the quota resets once it has run out.
+func (g *githubClient) recordRateLimit(header http.Header) {
+	if header.Get("X-RateLimit-Remaining") != "0" {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	g.mu.Lock()
+	g.resetAt = time.Unix(reset, 0)
+	g.mu.Unlock()
+}
+
+// waitForRateLimit blocks until the rate limit quota has been reset.
+func (g *githubClient) waitForRateLimit(ctx context.Context) error {
+	g.mu.Lock()
+	wait := time.Until(g.resetAt)
+	g.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	log.Printf("GitHub rate limit exhausted, waiting %s", wait)
+	return sleepContext(ctx, wait)
+}
+
+// retryAfter returns how long to wait before retrying a rate limited
+// request, as advised by the Retry-After or X-RateLimit-Reset headers.
+func retryAfter(header http.Header) time.Duration {
+	if secs, err := strconv.Atoi(header.Get("Retry-After")); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		if wait := time.Until(time.Unix(reset, 0)); wait > 0 {
+			return wait
+		}
+	}
+	return time.Minute
+}
+
+var nextLinkPattern = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// nextPageURL extracts the rel="next" URL from a Link header.
+func nextPageURL(link string) string {
+	m := nextLinkPattern.FindStringSubmatch(link)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// sleepContext sleeps for d or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+// githubPoller periodically collects completed GitHub Actions runs for
+// repositories where no webhook can be installed.
+type githubPoller struct {
+	client   *githubClient
+	repos    []string
+	lookback time.Duration
+
+	// watermarks holds, per repository, the creation time from which runs
+	// still have to be looked at.
+	watermarks map[string]time.Time
+}
+
+func newGitHubPoller(client *githubClient, repos []string, lookback time.Duration) *githubPoller {
+	return &githubPoller{
+		client:     client,
+		repos:      repos,
+		lookback:   lookback,
+		watermarks: make(map[string]time.Time),
+	}
+}
+
+// run polls every repository once per interval until the context is done.
+func (p *githubPoller) run(ctx context.Context, interval time.Duration) {
+	for {
+		for _, repo := range p.repos {
+			if err := p.pollRepo(ctx, repo); err != nil {
+				log.Printf("failed to poll GitHub runs for %s: %v", repo, err)
+			}
+		}
+		if err := sleepContext(ctx, interval); err != nil {
+			return
+		}
+	}
+}
+
+// pollRepo pages through the runs created since the repository watermark,
+// stores the completed ones and moves the watermark up to the oldest run
+// that is still in progress.
+func (p *githubPoller) pollRepo(ctx context.Context, repo string) error {
+	since, ok := p.watermarks[repo]
+	if !ok {
+		since = time.Now().Add(-p.lookback)
+	}
+	query := url.Values{}
+	query.Set("per_page", "100")
+	query.Set("created", ">="+since.UTC().Format(time.RFC3339))
+	next := fmt.Sprintf("%s/repos/%s/actions/runs?%s", p.client.baseURL, repo, query.Encode())
+
+	watermark := since
+	var pending *time.Time
+	stored := 0
+	for next != "" {
+		var page WorkflowRuns
+		var err error
+		if next, err = p.client.getJSON(ctx, next, &page); err != nil {
+			return err
+		}
+		for _, run := range page.WorkflowRuns {
+			if run.Status != "completed" {
+				if pending == nil || run.CreatedAt.Before(*pending) {
+					created := run.CreatedAt
+					pending = &created
+				}
+				continue
+			}
+			if run.CreatedAt.After(watermark) {
+				watermark = run.CreatedAt
+			}
+			ok, err := p.storeRun(ctx, run)
+			if err != nil {
+				log.Printf("failed to store GitHub run %d of %s: %v", run.ID, repo, err)
+				if pending == nil || run.CreatedAt.Before(*pending) {
+					created := run.CreatedAt
+					pending = &created
+				}
+				continue
+			}
+			if ok {
+				stored++
+			}
+		}
+	}
+	if pending != nil {
+		watermark = *pending
+	}
+	p.watermarks[repo] = watermark
+	log.Printf("polled GitHub runs for %s since %s, stored %d", repo, since.Format(time.RFC3339), stored)
+	return nil
+}
+
+// storeRun upserts a completed run together with its jobs. Runs whose stored
+// record is already up to date are skipped.
+func (p *githubPoller) storeRun(ctx context.Context, run Workflow) (bool, error) {
+	payload := PrepareWorkflowRunCiBuildData(run)
+	existing, err := getBuild(dbClient, "TektonCI", payload.Origin, payload.OriginalID)
+	if err != nil {
+		return false, err
+	}
+	if existing != nil && existing.CompletedAt == payload.CompletedAt && existing.TriggeredBy.LastActivity == payload.TriggeredBy.LastActivity {
+		return false, nil
+	}
+	jobs, err := p.client.listWorkflowJobs(ctx, run.JobsURL)
+	if err != nil {
+		return false, err
+	}
+	for _, job := range jobs {
+		payload.Stages = upsertStage(payload.Stages, workflowJobToStage(job))
+	}
+
+	buildMu.Lock()
+	defer buildMu.Unlock()
+	if err := storeBuild(dbClient, "TektonCI", payload); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// listWorkflowJobs pages through the jobs of every attempt of a workflow
+// run.
+func (g *githubClient) listWorkflowJobs(ctx context.Context, jobsURL string) ([]WorkflowJob, error) {
+	var jobs []WorkflowJob
+	next := jobsURL + "?filter=all&per_page=100"
+	for next != "" {
+		var page WorkflowJobs
+		var err error
+		if next, err = g.getJSON(ctx, next, &page); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, page.Jobs...)
+	}
+	return jobs, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// maxWebhookBodySize caps the size of webhook payloads read into memory.
+const maxWebhookBodySize = 25 << 20
+
+// readBody reads the request body, answering 413 for bodies larger than
+// maxWebhookBodySize rather than handling a truncated one. It reports
+// whether the body was read, having written the error response otherwise.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+		}
+		return nil, false
+	}
+	return body, true
+}
+
+type WorkflowRunEvent struct {
+	Action      string   `json:"action"`
+	WorkflowRun Workflow `json:"workflow_run"`
+	Repository  Repo     `json:"repository"`
+}
+
+type WorkflowJobEvent struct {
+	Action      string      `json:"action"`
+	WorkflowJob WorkflowJob `json:"workflow_job"`
+	Repository  Repo        `json:"repository"`
+}
+
+// githubWebhookHandler receives GitHub workflow_run and workflow_job webhooks
+// signed with the shared secret. When an API client is set, the jobs of
+// completed runs are fetched so that stages do not depend on workflow_job
+// deliveries.
+type githubWebhookHandler struct {
+	secret []byte
+	client *githubClient
+}
+
+func (h *githubWebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	if !validGitHubSignature(h.secret, body, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	receiveWebhook(w, r, "github."+r.Header.Get("X-GitHub-Event"), "github", r.Header.Get("X-GitHub-Delivery"), body)
+}
+
+// register adds the handlers of the GitHub webhook events. Other events,
+// such as ping, are ignored by handleUnknownEvent.
+func (h *githubWebhookHandler) register() {
+	eventHandlers[githubWorkflowRunEvent] = func(ctx context.Context, event cloudevents.Event) (string, error) {
+		return h.handleWorkflowRunEvent(ctx, event.Data())
+	}
+	eventHandlers[githubWorkflowJobEvent] = func(ctx context.Context, event cloudevents.Event) (string, error) {
+		return handleWorkflowJobEvent(event.Data())
+	}
+}
+
+// validGitHubSignature checks the sha256 HMAC GitHub computes over the body.
+func validGitHubSignature(secret, body []byte, signature string) bool {
+	sig, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+func (h *githubWebhookHandler) handleWorkflowRunEvent(ctx context.Context, body []byte) (string, error) {
+	var event WorkflowRunEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return "", &conversionError{fmt.Errorf("failed to decode workflow_run payload: %w", err)}
+	}
+	var jobs []WorkflowJob
+	if h.client != nil && event.WorkflowRun.Status == "completed" {
+		var err error
+		if jobs, err = h.client.listWorkflowJobs(ctx, event.WorkflowRun.JobsURL); err != nil {
+			return "", err
+		}
+	}
+	buildMu.Lock()
+	defer buildMu.Unlock()
+
+	payload := PrepareWorkflowRunCiBuildData(event.WorkflowRun)
+	existing, err := getBuild(dbClient, "TektonCI", payload.Origin, payload.OriginalID)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		payload.Stages = existing.Stages
+	}
+	for _, job := range jobs {
+		payload.Stages = upsertStage(payload.Stages, workflowJobToStage(job))
+	}
+	return storeBuildState(payload)
+}
+
+func handleWorkflowJobEvent(body []byte) (string, error) {
+	var event WorkflowJobEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return "", &conversionError{fmt.Errorf("failed to decode workflow_job payload: %w", err)}
+	}
+	job := event.WorkflowJob
+	buildMu.Lock()
+	defer buildMu.Unlock()
+
+	existing, err := getBuild(dbClient, "TektonCI", "GitHubActions", strconv.FormatInt(job.RunID, 10))
+	if err != nil {
+		return "", err
+	}
+	var payload CiBuildPayload
+	if existing != nil {
+		payload = *existing
+	} else {
+		payload = CiBuildPayload{
+			Origin:          "GitHubActions",
+			OriginalID:      strconv.FormatInt(job.RunID, 10),
+			Name:            job.WorkflowName,
+			URL:             strings.TrimSuffix(job.HTMLURL, "/job/"+strconv.FormatInt(job.ID, 10)),
+			CreatedAt:       job.CreatedAt.Unix(),
+			StartedAt:       job.StartedAt.Unix(),
+			Status:          "in_progress",
+			RepoURL:         event.Repository.HTMLURL,
+			Commit:          job.HeadSha,
+			PullRequestUrls: make([]string, 0),
+		}
+	}
+	payload.Stages = upsertStage(payload.Stages, workflowJobToStage(job))
+	return storeBuildState(payload)
+}
+
+// PrepareWorkflowRunCiBuildData converts a GitHub Actions workflow run into a
+// build. Stages are filled in separately from the run's jobs.
+func PrepareWorkflowRunCiBuildData(run Workflow) CiBuildPayload {
+	payload := CiBuildPayload{
+		Origin:          "GitHubActions",
+		OriginalID:      strconv.FormatInt(run.ID, 10),
+		Name:            run.Name,
+		URL:             run.HTMLURL,
+		CreatedAt:       run.CreatedAt.Unix(),
+		StartedAt:       run.RunStartedAt.Unix(),
+		Status:          run.Status,
+		Conclusion:      run.Conclusion,
+		RepoURL:         run.Repository.HTMLURL,
+		Commit:          run.HeadSha,
+		PullRequestUrls: make([]string, 0),
+		IsDeployment:    false,
+	}
+	if run.Status == "completed" {
+		payload.CompletedAt = run.UpdatedAt.Unix()
+	}
+	for _, pr := range run.PullRequests {
+		payload.PullRequestUrls = append(payload.PullRequestUrls, fmt.Sprintf("%s/pull/%d", run.Repository.HTMLURL, pr.Number))
+	}
+	actor := run.TriggeringActor.Login
+	if actor == "" {
+		actor = run.Actor.Login
+	}
+	payload.TriggeredBy = TriggeredBy{
+		Name:         actor,
+		AccountId:    actor,
+		LastActivity: run.UpdatedAt.Unix(),
+	}
+	return payload
+}
+
+// workflowJobToStage converts a GitHub Actions job into a stage with one job
+// per step. Jobs re-run in later attempts keep their own stage, named after
+// the attempt.
+func workflowJobToStage(job WorkflowJob) Stage {
+	stage := Stage{
+		ID:           strconv.FormatInt(job.ID, 10),
+		Name:         job.Name,
+		StartedAt:    job.StartedAt.Unix(),
+		Status:       githubStatus(job.Status, job.Conclusion),
+		Conclusion:   job.Conclusion,
+		URL:          job.HTMLURL,
+		Attempt:      job.RunAttempt,
+		RunnerLabels: job.Labels,
+	}
+	if job.RunAttempt > 1 {
+		stage.Name = fmt.Sprintf("%s (attempt %d)", job.Name, job.RunAttempt)
+	}
+	if job.CompletedAt != nil {
+		stage.CompletedAt = job.CompletedAt.Unix()
+	}
+	for _, step := range job.Steps {
+		stage.Jobs = append(stage.Jobs, Job{
+			StartedAt:   githubTime(step.StartedAt),
+			CompletedAt: githubTime(step.CompletedAt),
+			Name:        step.Name,
+			Status:      githubStatus(step.Status, step.Conclusion),
+			Conclusion:  step.Conclusion,
+		})
+	}
+	return stage
+}
+
+// upsertStage replaces the stage with the same ID, or appends it.
+func upsertStage(stages []Stage, stage Stage) []Stage {
+	for i := range stages {
+		if stages[i].ID == stage.ID {
+			stages[i] = stage
+			return stages
+		}
+	}
+	return append(stages, stage)
+}
+
+// githubStatus maps a GitHub status and conclusion onto the condition status
+// used for Tekton stages and jobs.
+func githubStatus(status, conclusion string) string {
+	if status != "completed" {
+		return string(corev1.ConditionUnknown)
+	}
+	if conclusion == "success" || conclusion == "skipped" || conclusion == "neutral" {
+		return string(corev1.ConditionTrue)
+	}
+	return string(corev1.ConditionFalse)
+}
+
+// githubTime returns the Unix seconds of t, or zero when the time is not set.
+func githubTime(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
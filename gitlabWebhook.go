@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	corev1 "k8s.io/api/core/v1"
+)
+
+type GitLabPipelineEvent struct {
+	ObjectKind       string `json:"object_kind"`
+	ObjectAttributes struct {
+		ID             int64       `json:"id"`
+		IID            int64       `json:"iid"`
+		Name           string      `json:"name"`
+		Ref            string      `json:"ref"`
+		Tag            bool        `json:"tag"`
+		Sha            string      `json:"sha"`
+		Source         string      `json:"source"`
+		Status         string      `json:"status"`
+		DetailedStatus string      `json:"detailed_status"`
+		Stages         []string    `json:"stages"`
+		CreatedAt      *gitlabTime `json:"created_at"`
+		FinishedAt     *gitlabTime `json:"finished_at"`
+		URL            string      `json:"url"`
+	} `json:"object_attributes"`
+	MergeRequest *struct {
+		ID  int64  `json:"id"`
+		IID int64  `json:"iid"`
+		URL string `json:"url"`
+	} `json:"merge_request"`
+	User    GitLabUser    `json:"user"`
+	Project GitLabProject `json:"project"`
+	Builds  []GitLabBuild `json:"builds"`
+}
+
+type GitLabBuild struct {
+	ID           int64         `json:"id"`
+	Stage        string        `json:"stage"`
+	Name         string        `json:"name"`
+	Status       string        `json:"status"`
+	CreatedAt    *gitlabTime   `json:"created_at"`
+	StartedAt    *gitlabTime   `json:"started_at"`
+	FinishedAt   *gitlabTime   `json:"finished_at"`
+	AllowFailure bool          `json:"allow_failure"`
+	Runner       *GitLabRunner `json:"runner"`
+	Environment  *struct {
+		Name   string `json:"name"`
+		Action string `json:"action"`
+	} `json:"environment"`
+}
+
+type GitLabJobEvent struct {
+	ObjectKind         string        `json:"object_kind"`
+	Ref                string        `json:"ref"`
+	Sha                string        `json:"sha"`
+	BuildID            int64         `json:"build_id"`
+	BuildName          string        `json:"build_name"`
+	BuildStage         string        `json:"build_stage"`
+	BuildStatus        string        `json:"build_status"`
+	BuildCreatedAt     *gitlabTime   `json:"build_created_at"`
+	BuildStartedAt     *gitlabTime   `json:"build_started_at"`
+	BuildFinishedAt    *gitlabTime   `json:"build_finished_at"`
+	BuildAllowFailure  bool          `json:"build_allow_failure"`
+	BuildFailureReason string        `json:"build_failure_reason"`
+	PipelineID         int64         `json:"pipeline_id"`
+	ProjectName        string        `json:"project_name"`
+	Runner             *GitLabRunner `json:"runner"`
+	User               GitLabUser    `json:"user"`
+	Repository         struct {
+		Name     string `json:"name"`
+		Homepage string `json:"homepage"`
+	} `json:"repository"`
+}
+
+type GitLabUser struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+type GitLabProject struct {
+	ID                int64  `json:"id"`
+	Name              string `json:"name"`
+	WebURL            string `json:"web_url"`
+	PathWithNamespace string `json:"path_with_namespace"`
+}
+
+type GitLabRunner struct {
+	ID          int64    `json:"id"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+// gitlabTime parses the timestamps found in GitLab webhooks, which use
+// either "2006-01-02 15:04:05 UTC" or RFC 3339.
+type gitlabTime struct {
+	time.Time
+}
+
+func (t *gitlabTime) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		return nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05 MST", "2006-01-02 15:04:05 -0700", time.RFC3339Nano} {
+		if parsed, err := time.Parse(layout, s); err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported GitLab time %q", s)
+}
+
+// unix returns the Unix seconds of t, or zero when the time is not set.
+func (t *gitlabTime) unix() int64 {
+	if t == nil || t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// gitlabWebhookHandler receives GitLab Pipeline Hook and Job Hook webhooks
+// carrying the shared secret token.
+type gitlabWebhookHandler struct {
+	token []byte
+}
+
+func (h *gitlabWebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare(h.token, []byte(r.Header.Get("X-Gitlab-Token"))) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	eventType := "gitlab." + r.Header.Get("X-Gitlab-Event")
+	switch r.Header.Get("X-Gitlab-Event") {
+	case "Pipeline Hook":
+		eventType = gitlabPipelineEvent
+	case "Job Hook":
+		eventType = gitlabJobEvent
+	}
+	receiveWebhook(w, r, eventType, "gitlab", r.Header.Get("X-Gitlab-Event-UUID"), body)
+}
+
+// register adds the handlers of the GitLab webhook events.
+func (h *gitlabWebhookHandler) register() {
+	eventHandlers[gitlabPipelineEvent] = func(ctx context.Context, event cloudevents.Event) (string, error) {
+		return handleGitLabPipelineEvent(event.Data())
+	}
+	eventHandlers[gitlabJobEvent] = func(ctx context.Context, event cloudevents.Event) (string, error) {
+		return handleGitLabJobEvent(event.Data())
+	}
+}
+
+func handleGitLabPipelineEvent(body []byte) (string, error) {
+	var event GitLabPipelineEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return "", &conversionError{fmt.Errorf("failed to decode pipeline payload: %w", err)}
+	}
+	buildMu.Lock()
+	defer buildMu.Unlock()
+
+	payload := PrepareGitLabPipelineCiBuildData(event)
+	existing, err := getBuild(dbClient, "TektonCI", payload.Origin, payload.OriginalID)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		payload.Stages = mergeGitLabStages(existing.Stages, payload.Stages)
+	}
+	return storeBuildState(payload)
+}
+
+// mergeGitLabStages merges the stages of a pipeline hook into the stages
+// already built from earlier hooks, so that jobs only known from job hooks
+// are kept.
+func mergeGitLabStages(existing, stages []Stage) []Stage {
+	merged := append([]Stage(nil), existing...)
+	for _, stage := range stages {
+		current := findStage(merged, stage.ID)
+		if current == nil {
+			merged = append(merged, stage)
+			continue
+		}
+		for _, job := range stage.Jobs {
+			current.Jobs = upsertJob(current.Jobs, job)
+		}
+		if len(stage.RunnerLabels) > 0 {
+			current.RunnerLabels = stage.RunnerLabels
+		}
+		current.URL = stage.URL
+		summariseStage(current)
+	}
+	return merged
+}
+
+func handleGitLabJobEvent(body []byte) (string, error) {
+	var event GitLabJobEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return "", &conversionError{fmt.Errorf("failed to decode job payload: %w", err)}
+	}
+	buildMu.Lock()
+	defer buildMu.Unlock()
+
+	id := strconv.FormatInt(event.PipelineID, 10)
+	existing, err := getBuild(dbClient, "TektonCI", "GitLab", id)
+	if err != nil {
+		return "", err
+	}
+	var payload CiBuildPayload
+	if existing != nil {
+		payload = *existing
+	} else {
+		payload = CiBuildPayload{
+			Origin:          "GitLab",
+			OriginalID:      id,
+			Name:            event.ProjectName,
+			URL:             fmt.Sprintf("%s/-/pipelines/%d", event.Repository.Homepage, event.PipelineID),
+			CreatedAt:       event.BuildCreatedAt.unix(),
+			StartedAt:       event.BuildStartedAt.unix(),
+			Status:          "running",
+			RepoURL:         event.Repository.Homepage,
+			Commit:          event.Sha,
+			PullRequestUrls: make([]string, 0),
+			TriggeredBy:     gitlabTriggeredBy(event.User),
+		}
+	}
+
+	job := gitlabJob(event.BuildID, event.BuildName, event.BuildStatus, event.BuildAllowFailure, event.BuildStartedAt, event.BuildFinishedAt)
+	if event.BuildFailureReason != "" && job.Status == string(corev1.ConditionFalse) {
+		job.Conclusion = event.BuildFailureReason
+	}
+	stage := findStage(payload.Stages, id+"/"+event.BuildStage)
+	if stage == nil {
+		payload.Stages = append(payload.Stages, Stage{ID: id + "/" + event.BuildStage, Name: event.BuildStage})
+		stage = &payload.Stages[len(payload.Stages)-1]
+	}
+	stage.Jobs = upsertJob(stage.Jobs, job)
+	if event.Runner != nil {
+		stage.RunnerLabels = event.Runner.Tags
+	}
+	summariseStage(stage)
+	return storeBuildState(payload)
+}
+
+// PrepareGitLabPipelineCiBuildData converts a GitLab pipeline into a build
+// with one stage per pipeline stage and one job per stage job.
+func PrepareGitLabPipelineCiBuildData(event GitLabPipelineEvent) CiBuildPayload {
+	attrs := event.ObjectAttributes
+	id := strconv.FormatInt(attrs.ID, 10)
+	name := attrs.Name
+	if name == "" {
+		name = event.Project.PathWithNamespace
+	}
+	payload := CiBuildPayload{
+		Origin:          "GitLab",
+		OriginalID:      id,
+		Name:            name,
+		URL:             attrs.URL,
+		CreatedAt:       attrs.CreatedAt.unix(),
+		StartedAt:       attrs.CreatedAt.unix(),
+		CompletedAt:     attrs.FinishedAt.unix(),
+		Status:          attrs.Status,
+		Conclusion:      attrs.DetailedStatus,
+		RepoURL:         event.Project.WebURL,
+		Commit:          attrs.Sha,
+		PullRequestUrls: make([]string, 0),
+		TriggeredBy:     gitlabTriggeredBy(event.User),
+	}
+	if event.MergeRequest != nil && event.MergeRequest.URL != "" {
+		payload.PullRequestUrls = append(payload.PullRequestUrls, event.MergeRequest.URL)
+	}
+	if !gitlabFinished(attrs.Status) {
+		payload.CompletedAt = 0
+	}
+
+	for _, stageName := range attrs.Stages {
+		stage := Stage{ID: id + "/" + stageName, Name: stageName, URL: attrs.URL}
+		for _, build := range event.Builds {
+			if build.Stage != stageName {
+				continue
+			}
+			stage.Jobs = append(stage.Jobs, gitlabJob(build.ID, build.Name, build.Status, build.AllowFailure, build.StartedAt, build.FinishedAt))
+			if build.Runner != nil {
+				stage.RunnerLabels = build.Runner.Tags
+			}
+			if build.Environment != nil && build.Environment.Action == "start" && build.Status == "success" {
+				payload.IsDeployment = true
+			}
+		}
+		summariseStage(&stage)
+		payload.Stages = append(payload.Stages, stage)
+	}
+	return payload
+}
+
+func gitlabTriggeredBy(user GitLabUser) TriggeredBy {
+	return TriggeredBy{
+		Name:      user.Name,
+		Email:     user.Email,
+		AccountId: user.Username,
+	}
+}
+
+// gitlabJob converts a GitLab job into a job with the condition status used
+// for Tekton jobs. Failures that are allowed do not fail the job, nor do
+// skipped jobs and manual jobs nobody started.
+func gitlabJob(id int64, name, status string, allowFailure bool, startedAt, finishedAt *gitlabTime) Job {
+	job := Job{
+		ID:          strconv.FormatInt(id, 10),
+		Name:        name,
+		StartedAt:   startedAt.unix(),
+		CompletedAt: finishedAt.unix(),
+		Conclusion:  status,
+	}
+	switch {
+	case status == "success" || status == "skipped" || status == "manual" || (status == "failed" && allowFailure):
+		job.Status = string(corev1.ConditionTrue)
+	case gitlabFinished(status):
+		job.Status = string(corev1.ConditionFalse)
+	default:
+		job.Status = string(corev1.ConditionUnknown)
+	}
+	return job
+}
+
+// gitlabFinished reports whether a GitLab pipeline or job status is final.
+func gitlabFinished(status string) bool {
+	switch status {
+	case "success", "failed", "canceled", "skipped":
+		return true
+	}
+	return false
+}
+
+// summariseStage derives the timing and status of a stage from its jobs.
+// Only the latest attempt of a retried job decides the status.
+func summariseStage(stage *Stage) {
+	stage.StartedAt, stage.CompletedAt = 0, 0
+	latest := make(map[string]int)
+	for i, job := range stage.Jobs {
+		latest[job.Name] = i
+	}
+	status := string(corev1.ConditionTrue)
+	for i, job := range stage.Jobs {
+		if job.StartedAt != 0 && (stage.StartedAt == 0 || job.StartedAt < stage.StartedAt) {
+			stage.StartedAt = job.StartedAt
+		}
+		if job.CompletedAt > stage.CompletedAt {
+			stage.CompletedAt = job.CompletedAt
+		}
+		if latest[job.Name] != i {
+			continue
+		}
+		switch {
+		case job.Status == string(corev1.ConditionFalse):
+			status = job.Status
+		case job.Status == string(corev1.ConditionUnknown) && status == string(corev1.ConditionTrue):
+			status = job.Status
+		}
+	}
+	stage.Status = status
+	switch status {
+	case string(corev1.ConditionTrue):
+		stage.Conclusion = "success"
+	case string(corev1.ConditionFalse):
+		stage.Conclusion = "failed"
+	default:
+		stage.Conclusion = "running"
+		stage.CompletedAt = 0
+	}
+}
+
+// findStage returns the stage with the given ID, or nil.
+func findStage(stages []Stage, id string) *Stage {
+	for i := range stages {
+		if stages[i].ID == id {
+			return &stages[i]
+		}
+	}
+	return nil
+}
+
+// upsertJob replaces the job with the same ID, or appends it. Retried jobs
+// have IDs of their own and are kept next to the attempts they retry. A
+// finished job is not replaced by an older, unfinished state of it.
+func upsertJob(jobs []Job, job Job) []Job {
+	for i := range jobs {
+		if jobs[i].ID == job.ID {
+			if jobs[i].CompletedAt == 0 || job.CompletedAt != 0 {
+				jobs[i] = job
+			}
+			return jobs
+		}
+	}
+	return append(jobs, job)
+}
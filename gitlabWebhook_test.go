@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestMergeGitLabStages(t *testing.T) {
+	existing := []Stage{{ID: "7/test", Name: "test", Jobs: []Job{
+		{ID: "100", Name: "unit", Status: "False", Conclusion: "failed", StartedAt: 10, CompletedAt: 20},
+		{ID: "101", Name: "unit", Status: "True", Conclusion: "success", StartedAt: 30, CompletedAt: 40},
+	}}}
+	hook := []Stage{
+		{ID: "7/test", Name: "test", Jobs: []Job{
+			// an older state of the retry, sent before the job hook
+			{ID: "101", Name: "unit", Status: "Unknown", Conclusion: "running", StartedAt: 30},
+		}},
+		{ID: "7/deploy", Name: "deploy", Jobs: []Job{
+			gitlabJob(102, "deploy", "manual", false, nil, nil),
+		}},
+	}
+	for i := range hook {
+		summariseStage(&hook[i])
+	}
+	stages := mergeGitLabStages(existing, hook)
+	if len(stages) != 2 {
+		t.Fatalf("got %d stages, want 2", len(stages))
+	}
+	test := stages[0]
+	if len(test.Jobs) != 2 || test.Jobs[1].Conclusion != "success" {
+		t.Errorf("test jobs = %+v, want both attempts with the retry finished", test.Jobs)
+	}
+	if test.Status != "True" || test.CompletedAt != 40 {
+		t.Errorf("test stage %s completed %d, want the retry to decide it, True completed 40", test.Status, test.CompletedAt)
+	}
+	if deploy := stages[1]; deploy.Status != "True" || deploy.Conclusion != "success" {
+		t.Errorf("deploy stage %s/%s, want a manual job to leave it finished", deploy.Status, deploy.Conclusion)
+	}
+}
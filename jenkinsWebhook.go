@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// JenkinsNotification is the job payload sent by the Jenkins Notification
+// plugin.
+type JenkinsNotification struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Build struct {
+		FullURL   string `json:"full_url"`
+		Number    int    `json:"number"`
+		QueueID   int64  `json:"queue_id"`
+		Timestamp int64  `json:"timestamp"`
+		Duration  int64  `json:"duration"`
+		Phase     string `json:"phase"`
+		Status    string `json:"status"`
+		URL       string `json:"url"`
+		SCM       struct {
+			URL      string   `json:"url"`
+			Branch   string   `json:"branch"`
+			Commit   string   `json:"commit"`
+			Culprits []string `json:"culprits"`
+		} `json:"scm"`
+		Parameters map[string]string `json:"parameters"`
+	} `json:"build"`
+}
+
+// JenkinsRunDescription is the Pipeline run summary served by the Pipeline
+// Stage View plugin at /wfapi/describe.
+type JenkinsRunDescription struct {
+	ID              string         `json:"id"`
+	Name            string         `json:"name"`
+	Status          string         `json:"status"`
+	StartTimeMillis int64          `json:"startTimeMillis"`
+	EndTimeMillis   int64          `json:"endTimeMillis"`
+	Stages          []JenkinsStage `json:"stages"`
+}
+
+type JenkinsStage struct {
+	ID              string         `json:"id"`
+	Name            string         `json:"name"`
+	Status          string         `json:"status"`
+	StartTimeMillis int64          `json:"startTimeMillis"`
+	DurationMillis  int64          `json:"durationMillis"`
+	StageFlowNodes  []JenkinsStage `json:"stageFlowNodes"`
+}
+
+// jenkinsWebhookHandler receives Jenkins build notifications. The shared
+// token is passed as a query parameter since the plugin cannot set headers.
+type jenkinsWebhookHandler struct {
+	token []byte
+	// baseURL is the Jenkins whose builds have their stage timings fetched
+	// from /wfapi/describe, authenticated as user with apiToken. Builds the
+	// notifications place elsewhere are stored without stages.
+	baseURL    *url.URL
+	user       string
+	apiToken   string
+	httpClient *http.Client
+}
+
+// jenkinsStageFetch is a completed build waiting for its stages, carried
+// by jenkinsStagesEvent events.
+type jenkinsStageFetch struct {
+	// ID is the OriginalID of the build
+	ID       string `json:"id"`
+	BuildURL string `json:"buildURL"`
+}
+
+// newJenkinsWebhookHandler creates a handler accepting notifications with
+// the token. Stage timings are fetched only when baseURL and user are set.
+func newJenkinsWebhookHandler(token, baseURL, user, apiToken string) (*jenkinsWebhookHandler, error) {
+	h := &jenkinsWebhookHandler{
+		token:      []byte(token),
+		user:       user,
+		apiToken:   apiToken,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	if baseURL != "" {
+		u, err := url.Parse(strings.TrimSuffix(baseURL, "/") + "/")
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid Jenkins URL %q", baseURL)
+		}
+		h.baseURL = u
+	}
+	return h, nil
+}
+
+func (h *jenkinsWebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare(h.token, []byte(r.URL.Query().Get("token"))) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	receiveWebhook(w, r, jenkinsBuildEvent, "jenkins", "", body)
+}
+
+// register adds the handlers of Jenkins build notifications and of the
+// stage fetches they queue.
+func (h *jenkinsWebhookHandler) register() {
+	eventHandlers[jenkinsBuildEvent] = func(ctx context.Context, event cloudevents.Event) (string, error) {
+		return h.handleNotification(ctx, event.Data())
+	}
+	eventHandlers[jenkinsStagesEvent] = func(ctx context.Context, event cloudevents.Event) (string, error) {
+		return h.handleStageFetch(ctx, event.Data())
+	}
+}
+
+func (h *jenkinsWebhookHandler) handleNotification(ctx context.Context, body []byte) (string, error) {
+	var notification JenkinsNotification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return "", &conversionError{fmt.Errorf("failed to decode build payload: %w", err)}
+	}
+	payload := PrepareJenkinsCiBuildData(notification)
+	buildMu.Lock()
+	outcome, err := storeBuildState(payload)
+	buildMu.Unlock()
+	if err != nil || payload.Status != "COMPLETED" && payload.Status != "FINALIZED" || h.baseURL == nil || h.user == "" {
+		return outcome, err
+	}
+	buildURL, ok := h.buildURL(notification.Build.FullURL)
+	if !ok {
+		log.Printf("not fetching stages of %s, it is not a build of %s", notification.Build.FullURL, h.baseURL)
+		return outcome, nil
+	}
+	if err := queueStageFetch(jenkinsStageFetch{ID: payload.OriginalID, BuildURL: buildURL}); err != nil {
+		return "", err
+	}
+	return outcome, nil
+}
+
+// queueStageFetch passes the fetch on as a jenkinsStagesEvent. With a
+// queue configured the fetch is persisted, so it survives restarts and is
+// retried like any other event. Without one it is made in the background,
+// so the notification is not held up either way.
+func queueStageFetch(fetch jenkinsStageFetch) error {
+	event := cloudevents.NewEvent()
+	event.SetID("jenkins-stages-" + fetch.ID)
+	event.SetSource("jenkins")
+	event.SetType(jenkinsStagesEvent)
+	event.SetTime(time.Now())
+	if err := event.SetData(cloudevents.ApplicationJSON, fetch); err != nil {
+		return fmt.Errorf("failed to encode stage fetch of %s: %w", fetch.ID, err)
+	}
+	if eventQueue != nil {
+		return eventQueue.enqueue(event)
+	}
+	go func() {
+		if err := dispatchEvent(context.Background(), event); err != nil {
+			log.Printf("failed to fetch stages of %s: %v", fetch.BuildURL, err)
+		}
+	}()
+	return nil
+}
+
+// buildURL returns the build URL a notification names if it is a build of
+// the configured Jenkins, so that the API token is only ever sent there.
+func (h *jenkinsWebhookHandler) buildURL(fullURL string) (string, bool) {
+	u, err := url.Parse(fullURL)
+	if err != nil || u.Scheme != h.baseURL.Scheme || u.Host != h.baseURL.Host || u.User != nil {
+		return "", false
+	}
+	if !strings.HasPrefix(path.Clean(u.Path)+"/", h.baseURL.Path) {
+		return "", false
+	}
+	return h.baseURL.Scheme + "://" + h.baseURL.Host + path.Clean(u.Path), true
+}
+
+// handleStageFetch adds the stages of a completed build to its record,
+// along with its completion time when the notification had none.
+func (h *jenkinsWebhookHandler) handleStageFetch(ctx context.Context, body []byte) (string, error) {
+	var fetch jenkinsStageFetch
+	if err := json.Unmarshal(body, &fetch); err != nil {
+		return "", &conversionError{fmt.Errorf("failed to decode stage fetch: %w", err)}
+	}
+	if h.baseURL == nil || h.user == "" {
+		return outcomeIgnored, nil
+	}
+	buildURL, ok := h.buildURL(fetch.BuildURL)
+	if !ok {
+		return "", &conversionError{fmt.Errorf("not fetching stages of %s, it is not a build of %s", fetch.BuildURL, h.baseURL)}
+	}
+	stages, end, err := h.describeStages(ctx, buildURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch stages of %s: %w", buildURL, err)
+	}
+	buildMu.Lock()
+	defer buildMu.Unlock()
+	payload, err := getBuild(dbClient, "TektonCI", "Jenkins", fetch.ID)
+	if err != nil || payload == nil {
+		return outcomeIgnored, err
+	}
+	payload.Stages = stages
+	if payload.CompletedAt == 0 && end != 0 {
+		payload.CompletedAt = end
+		payload.MissingFields = removeField(payload.MissingFields, missingCompletionTime)
+	}
+	return storeBuildState(*payload)
+}
+
+// removeField returns fields without field.
+func removeField(fields []string, field string) []string {
+	var kept []string
+	for _, f := range fields {
+		if f != field {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// PrepareJenkinsCiBuildData converts a Jenkins build notification into a
+// build. Stages are only known for Pipeline jobs, through /wfapi/describe.
+func PrepareJenkinsCiBuildData(n JenkinsNotification) CiBuildPayload {
+	build := n.Build
+	payload := CiBuildPayload{
+		Origin:          "Jenkins",
+		OriginalID:      fmt.Sprintf("%s#%d", n.Name, build.Number),
+		Name:            n.Name,
+		URL:             build.FullURL,
+		CreatedAt:       build.Timestamp / 1000,
+		StartedAt:       build.Timestamp / 1000,
+		Status:          build.Phase,
+		Conclusion:      build.Status,
+		RepoURL:         build.SCM.URL,
+		Commit:          build.SCM.Commit,
+		PullRequestUrls: make([]string, 0),
+	}
+	if build.Phase == "COMPLETED" || build.Phase == "FINALIZED" {
+		// the duration is not always sent, the stage timings then tell when
+		// the build completed
+		if build.Duration > 0 {
+			payload.CompletedAt = (build.Timestamp + build.Duration) / 1000
+		} else {
+			payload.MissingFields = []string{missingCompletionTime}
+		}
+	}
+	return payload
+}
+
+// describeStages fetches the Pipeline stages of a run along with the steps
+// of each stage, and when the run ended.
+func (h *jenkinsWebhookHandler) describeStages(ctx context.Context, buildURL string) ([]Stage, int64, error) {
+	buildURL = strings.TrimSuffix(buildURL, "/")
+	var run JenkinsRunDescription
+	if err := h.getJSON(ctx, buildURL+"/wfapi/describe", &run); err != nil {
+		return nil, 0, err
+	}
+	var stages []Stage
+	for _, s := range run.Stages {
+		stage := Stage{
+			ID:          s.ID,
+			Name:        s.Name,
+			StartedAt:   s.StartTimeMillis / 1000,
+			CompletedAt: (s.StartTimeMillis + s.DurationMillis) / 1000,
+			Status:      jenkinsStatus(s.Status),
+			Conclusion:  s.Status,
+			URL:         fmt.Sprintf("%s/execution/node/%s/", buildURL, s.ID),
+		}
+		var detail JenkinsStage
+		if err := h.getJSON(ctx, fmt.Sprintf("%s/execution/node/%s/wfapi/describe", buildURL, s.ID), &detail); err != nil {
+			log.Printf("failed to fetch steps of stage %s: %v", s.Name, err)
+		}
+		for _, node := range detail.StageFlowNodes {
+			stage.Jobs = append(stage.Jobs, Job{
+				StartedAt:   node.StartTimeMillis / 1000,
+				CompletedAt: (node.StartTimeMillis + node.DurationMillis) / 1000,
+				Name:        node.Name,
+				Status:      jenkinsStatus(node.Status),
+				Conclusion:  node.Status,
+			})
+		}
+		stages = append(stages, stage)
+	}
+	return stages, run.EndTimeMillis / 1000, nil
+}
+
+func (h *jenkinsWebhookHandler) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(h.user, h.apiToken)
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jenkinsStatus maps a Jenkins result onto the condition status used for
+// Tekton stages and jobs.
+func jenkinsStatus(status string) string {
+	switch status {
+	case "SUCCESS", "UNSTABLE", "NOT_EXECUTED":
+		return string(corev1.ConditionTrue)
+	case "FAILED", "FAILURE", "ABORTED":
+		return string(corev1.ConditionFalse)
+	}
+	return string(corev1.ConditionUnknown)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrepareJenkinsCiBuildDataCompletion(t *testing.T) {
+	tests := []struct {
+		name          string
+		phase         string
+		duration      int64
+		completedAt   int64
+		missingFields []string
+	}{
+		{name: "started", phase: "STARTED"},
+		{name: "completed", phase: "COMPLETED", duration: 300000, completedAt: 1714557900},
+		{name: "completed without duration", phase: "COMPLETED", missingFields: []string{missingCompletionTime}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var n JenkinsNotification
+			n.Name = "app"
+			n.Build.Number = 3
+			n.Build.Timestamp = 1714557600000
+			n.Build.Duration = tt.duration
+			n.Build.Phase = tt.phase
+			payload := PrepareJenkinsCiBuildData(n)
+			if payload.OriginalID != "app#3" || payload.StartedAt != 1714557600 {
+				t.Errorf("build %s started %d, want app#3 started 1714557600", payload.OriginalID, payload.StartedAt)
+			}
+			if payload.CompletedAt != tt.completedAt {
+				t.Errorf("CompletedAt = %d, want %d", payload.CompletedAt, tt.completedAt)
+			}
+			if !reflect.DeepEqual(payload.MissingFields, tt.missingFields) {
+				t.Errorf("MissingFields = %v, want %v", payload.MissingFields, tt.missingFields)
+			}
+		})
+	}
+}
+
+func TestJenkinsBuildURL(t *testing.T) {
+	h, err := newJenkinsWebhookHandler("token", "https://ci.example.com/jenkins", "bot", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		fullURL string
+		want    string
+		ok      bool
+	}{
+		{"https://ci.example.com/jenkins/job/app/3/", "https://ci.example.com/jenkins/job/app/3", true},
+		{"https://ci.example.com/jenkins/job/../../admin", "", false},
+		{"https://ci.example.com/other/job/app/3/", "", false},
+		{"https://evil.example.com/jenkins/job/app/3/", "", false},
+		{"http://ci.example.com/jenkins/job/app/3/", "", false},
+		{"https://user@ci.example.com/jenkins/job/app/3/", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := h.buildURL(tt.fullURL)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("buildURL(%q) = %q, %v, want %q, %v", tt.fullURL, got, ok, tt.want, tt.ok)
+		}
+	}
+}
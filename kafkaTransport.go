@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+// Media types of the Kafka REST Proxy v2 API.
+const (
+	kafkaV2ContentType     = "application/vnd.kafka.v2+json"
+	kafkaBinaryContentType = "application/vnd.kafka.binary.v2+json"
+)
+
+// maxRecordAttempts bounds how often a record is consumed again after a
+// failure before it is dead-lettered so that its partition moves on.
+const maxRecordAttempts = 10
+
+// kafkaTransport consumes CloudEvents from a Kafka topic through the Kafka
+// REST Proxy v2 API as a member of a consumer group. Records must hold
+// structured or batch mode CloudEvents, the proxy does not expose record
+// headers. Offsets are committed only once the receiver has handled a
+// record, so events whose store failed are consumed again.
+type kafkaTransport struct {
+	baseURL    string
+	topic      string
+	group      string
+	httpClient *http.Client
+	// auth restricts the accepted event sources, records are not signed
+	auth *eventAuth
+
+	// instanceURL is the consumer instance created by start
+	instanceURL string
+	// attempts counts the failures of records consumed again
+	attempts map[KafkaOffset]int
+}
+
+// KafkaRecord is a record returned by the REST Proxy in binary format, the
+// value is base64 encoded on the wire.
+type KafkaRecord struct {
+	Topic     string `json:"topic"`
+	Value     []byte `json:"value"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+type KafkaOffset struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+func newKafkaTransport(baseURL, topic, group string, auth *eventAuth) *kafkaTransport {
+	return &kafkaTransport{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		topic:      topic,
+		group:      group,
+		httpClient: &http.Client{Timeout: time.Minute},
+		auth:       auth,
+		attempts:   make(map[KafkaOffset]int),
+	}
+}
+
+// start joins the consumer group, subscribes to the topic and consumes in
+// the background. The consumer instance is deleted when the context is done
+// so the group rebalances right away.
+func (t *kafkaTransport) start(ctx context.Context, fn receiverFunc) error {
+	name, err := os.Hostname()
+	if err != nil {
+		name = fmt.Sprintf("event-listener-%d", time.Now().UnixNano())
+	}
+	consumer := map[string]string{
+		"name":               name,
+		"format":             "binary",
+		"auto.offset.reset":  "earliest",
+		"auto.commit.enable": "false",
+	}
+	var instance struct {
+		BaseURI string `json:"base_uri"`
+	}
+	if err := t.do(ctx, http.MethodPost, t.baseURL+"/consumers/"+t.group, consumer, &instance); err != nil {
+		return fmt.Errorf("failed to create Kafka consumer: %w", err)
+	}
+	t.instanceURL = instance.BaseURI
+	subscription := map[string][]string{"topics": {t.topic}}
+	if err := t.do(ctx, http.MethodPost, t.instanceURL+"/subscription", subscription, nil); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", t.topic, err)
+	}
+	log.Printf("consuming CloudEvents from Kafka topic %s as %s/%s\n", t.topic, t.group, name)
+
+	go func() {
+		t.consume(ctx, t.auth.receiver(fn))
+		if err := t.do(context.Background(), http.MethodDelete, t.instanceURL, nil, nil); err != nil {
+			log.Printf("failed to delete Kafka consumer: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (t *kafkaTransport) consume(ctx context.Context, fn receiverFunc) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		var records []KafkaRecord
+		if err := t.do(ctx, http.MethodGet, t.instanceURL+"/records", nil, &records); err != nil {
+			log.Printf("failed to fetch Kafka records: %v", err)
+			_ = sleepContext(ctx, backoff)
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		if err := t.handleRecords(ctx, records, fn); err != nil {
+			log.Printf("failed to handle Kafka records: %v", err)
+			_ = sleepContext(ctx, backoff)
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		backoff = time.Second
+	}
+}
+
+// handleRecords passes the records to fn in order. Offsets of the handled
+// records are committed; a partition whose record failed is rewound to it
+// and the rest of its records are left for the next fetch. A record that
+// failed maxRecordAttempts times is dead-lettered instead when a store is
+// configured.
+func (t *kafkaTransport) handleRecords(ctx context.Context, records []KafkaRecord, fn receiverFunc) error {
+	handled := make(map[int]KafkaOffset)
+	failed := make(map[int]KafkaOffset)
+	for _, record := range records {
+		if _, ok := failed[record.Partition]; ok {
+			continue
+		}
+		offset := KafkaOffset{Topic: record.Topic, Partition: record.Partition, Offset: record.Offset}
+		if err := receiveRecord(ctx, record.Value, fn); err != nil {
+			log.Printf("failed to handle record %d of %s/%d: %v", record.Offset, record.Topic, record.Partition, err)
+			t.attempts[offset]++
+			if t.attempts[offset] < maxRecordAttempts || deadLetters == nil {
+				failed[record.Partition] = offset
+				continue
+			}
+			if dlErr := putDeadRecord(record.Value, err); dlErr != nil {
+				log.Printf("failed to dead-letter record %d of %s/%d: %v", record.Offset, record.Topic, record.Partition, dlErr)
+				failed[record.Partition] = offset
+				continue
+			}
+		}
+		delete(t.attempts, offset)
+		handled[record.Partition] = offset
+	}
+
+	if len(handled) > 0 {
+		commit := struct {
+			Offsets []KafkaOffset `json:"offsets"`
+		}{}
+		for _, offset := range handled {
+			commit.Offsets = append(commit.Offsets, offset)
+		}
+		if err := t.do(ctx, http.MethodPost, t.instanceURL+"/offsets", commit, nil); err != nil {
+			return fmt.Errorf("failed to commit offsets: %w", err)
+		}
+	}
+	if len(failed) > 0 {
+		seek := struct {
+			Offsets []KafkaOffset `json:"offsets"`
+		}{}
+		for _, offset := range failed {
+			seek.Offsets = append(seek.Offsets, offset)
+		}
+		if err := t.do(ctx, http.MethodPost, t.instanceURL+"/positions", seek, nil); err != nil {
+			return fmt.Errorf("failed to rewind partitions: %w", err)
+		}
+		return fmt.Errorf("%d partitions rewound after failed records", len(failed))
+	}
+	return nil
+}
+
+// receiveRecord decodes a record holding a structured mode CloudEvent or a
+// JSON batch of them and hands the events to fn. Records that are not
+// CloudEvents and events that are rejected are dead-lettered, or logged
+// and skipped when there is no store, consuming them again cannot help.
+func receiveRecord(ctx context.Context, value []byte, fn receiverFunc) error {
+	var events []cloudevents.Event
+	value = bytes.TrimSpace(value)
+	if len(value) > 0 && value[0] == '[' {
+		if err := json.Unmarshal(value, &events); err != nil {
+			skipRecord(value, fmt.Errorf("record is not a CloudEvents batch: %w", err))
+			return nil
+		}
+	} else {
+		event := cloudevents.NewEvent()
+		if err := json.Unmarshal(value, &event); err != nil {
+			skipRecord(value, fmt.Errorf("record is not a CloudEvent: %w", err))
+			return nil
+		}
+		events = append(events, event)
+	}
+	for _, event := range events {
+		if err := event.Validate(); err != nil {
+			skipEvent(event, fmt.Errorf("invalid CloudEvent: %w", err))
+			continue
+		}
+		if err := fn(ctx, event); err != nil {
+			if isPermanent(err) {
+				skipEvent(event, err)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// skipRecord dead-letters a record that holds no CloudEvent.
+func skipRecord(value []byte, cause error) {
+	if deadLetters == nil {
+		log.Printf("skipping record: %v", cause)
+		return
+	}
+	if err := putDeadRecord(value, cause); err != nil {
+		log.Printf("failed to dead-letter record, skipping it: %v: %v", cause, err)
+	}
+}
+
+// skipEvent dead-letters an event that cannot be received.
+func skipEvent(event cloudevents.Event, cause error) {
+	if deadLetters == nil {
+		log.Printf("skipping event %s: %v", event.ID(), cause)
+		return
+	}
+	if err := putDeadLetter(event, cause); err != nil {
+		log.Printf("failed to dead-letter event %s, skipping it: %v: %v", event.ID(), cause, err)
+	}
+}
+
+// do sends body as JSON to the REST Proxy and decodes the response into v
+// when it is set.
+func (t *kafkaTransport) do(ctx context.Context, method, url string, body, v interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", kafkaV2ContentType)
+	}
+	if strings.HasSuffix(url, "/records") {
+		req.Header.Set("Accept", kafkaBinaryContentType)
+	} else {
+		req.Header.Set("Accept", kafkaV2ContentType)
+	}
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s returned %d", method, url, resp.StatusCode)
+	}
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
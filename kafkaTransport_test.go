@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+// fakeRESTProxy records the offsets committed and the positions sought
+// through the consumer instance API.
+type fakeRESTProxy struct {
+	mu        sync.Mutex
+	committed []KafkaOffset
+	sought    []KafkaOffset
+}
+
+func (f *fakeRESTProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Offsets []KafkaOffset `json:"offsets"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/offsets":
+		f.committed = append(f.committed, body.Offsets...)
+	case "/positions":
+		f.sought = append(f.sought, body.Offsets...)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeRESTProxy) reset() ([]KafkaOffset, []KafkaOffset) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	committed, sought := f.committed, f.sought
+	f.committed, f.sought = nil, nil
+	return committed, sought
+}
+
+func kafkaRecord(t *testing.T, partition int, offset int64, id string) KafkaRecord {
+	t.Helper()
+	event := cloudevents.NewEvent()
+	event.SetID(id)
+	event.SetSource("/test")
+	event.SetType("dev.tekton.event.pipelinerun.successful.v1")
+	value, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return KafkaRecord{Topic: "tekton", Partition: partition, Offset: offset, Value: value}
+}
+
+func TestKafkaHandleRecords(t *testing.T) {
+	store := &dirDeadLetters{dir: t.TempDir()}
+	deadLetters = store
+	t.Cleanup(func() { deadLetters = nil })
+
+	proxy := &fakeRESTProxy{}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	transport := newKafkaTransport(server.URL, "tekton", "test", nil)
+	transport.instanceURL = server.URL
+
+	unavailable := errors.New("table unavailable")
+	fn := func(ctx context.Context, event cloudevents.Event) error {
+		if event.ID() == "slow" {
+			return unavailable
+		}
+		return nil
+	}
+	records := []KafkaRecord{
+		kafkaRecord(t, 0, 10, "first"),
+		{Topic: "tekton", Partition: 0, Offset: 11, Value: []byte("not a CloudEvent")},
+		kafkaRecord(t, 1, 20, "slow"),
+		kafkaRecord(t, 1, 21, "after-slow"),
+	}
+
+	if err := transport.handleRecords(context.Background(), records, fn); err == nil {
+		t.Fatal("handleRecords succeeded, want an error for the rewound partition")
+	}
+	committed, sought := proxy.reset()
+	if len(committed) != 1 || committed[0].Partition != 0 || committed[0].Offset != 11 {
+		t.Errorf("committed %v, want partition 0 up to the poison record", committed)
+	}
+	if len(sought) != 1 || sought[0].Partition != 1 || sought[0].Offset != 20 {
+		t.Errorf("sought %v, want partition 1 rewound to the failed record", sought)
+	}
+	letters, err := store.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || string(letters[0].Event) != `"not a CloudEvent"` {
+		t.Fatalf("dead letters = %+v, want the poison record", letters)
+	}
+
+	// The failing record keeps its partition from moving on until it has
+	// failed maxRecordAttempts times.
+	for attempt := 2; attempt <= maxRecordAttempts; attempt++ {
+		err := transport.handleRecords(context.Background(), records[2:], fn)
+		committed, sought = proxy.reset()
+		if attempt < maxRecordAttempts {
+			if err == nil || len(committed) != 0 || len(sought) != 1 {
+				t.Fatalf("attempt %d: err = %v, committed %v, sought %v, want the partition rewound", attempt, err, committed, sought)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("attempt %d: %v, want the record dead-lettered", attempt, err)
+		}
+		if len(committed) != 1 || committed[0].Offset != 21 || len(sought) != 0 {
+			t.Fatalf("attempt %d: committed %v, sought %v, want partition 1 committed", attempt, committed, sought)
+		}
+	}
+	if letters, _ := store.list(); len(letters) != 2 {
+		t.Errorf("dead letters = %d, want the failing record as well", len(letters))
+	}
+}
@@ -2,51 +2,110 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"os"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/rest"
+	"knative.dev/pkg/apis"
 )
 
 type envConfig struct {
 	// Port on which to listen for cloudevents
 	Port int    `envconfig:"RCV_PORT" default:"8080"`
 	Path string `envconfig:"RCV_PATH" default:"/"`
+	// Transport CloudEvents arrive on, http or kafka
+	Transport string `envconfig:"EVENT_TRANSPORT" default:"http"`
+	// Authentication of CloudEvents received over HTTP: requests must be
+	// signed with the HMAC secret or carry one of the bearer tokens in the
+	// tokens file when either is set, and event sources must match the
+	// allowlist patterns when it is set
+	EventHMACSecret      string   `envconfig:"EVENT_HMAC_SECRET"`
+	EventTokensFile      string   `envconfig:"EVENT_TOKENS_FILE"`
+	EventSourceAllowlist []string `envconfig:"EVENT_SOURCE_ALLOWLIST"`
+	// Kafka REST Proxy consumed from by the kafka transport. The proxy does
+	// not expose record headers, so the transport only starts once
+	// KafkaStructuredMode confirms producers send structured or batch mode
+	// events
+	KafkaRESTURL        string `envconfig:"KAFKA_REST_URL"`
+	KafkaTopic          string `envconfig:"KAFKA_TOPIC"`
+	KafkaConsumerGroup  string `envconfig:"KAFKA_CONSUMER_GROUP" default:"event-listener"`
+	KafkaStructuredMode bool   `envconfig:"KAFKA_STRUCTURED_MODE" default:"false"`
+	// Directory of the write-ahead queue, on a persistent volume, events are
+	// stored synchronously when it is empty
+	QueueDir string `envconfig:"QUEUE_DIR"`
+	// Events that cannot be converted are kept in the dead-letter directory
+	// or DynamoDB table and served on DeadLetterPath of the metrics port,
+	// guarded by the token, which is required when a store is configured
+	DeadLetterDir      string `envconfig:"DEAD_LETTER_DIR"`
+	DeadLetterTable    string `envconfig:"DEAD_LETTER_TABLE"`
+	DeadLetterPath     string `envconfig:"DEAD_LETTER_PATH" default:"/deadletters"`
+	DeadLetterAPIToken string `envconfig:"DEAD_LETTER_API_TOKEN"`
+	// Port on which to expose Prometheus metrics
+	MetricsPort int `envconfig:"METRICS_PORT" default:"9090"`
+	// Secret shared with GitHub to sign webhooks, the GitHub endpoint is
+	// disabled when it is empty
+	GitHubWebhookSecret string `envconfig:"GITHUB_WEBHOOK_SECRET"`
+	GitHubWebhookPath   string `envconfig:"GITHUB_WEBHOOK_PATH" default:"/github"`
+	// Secret token GitLab sends with webhooks, the GitLab endpoint is
+	// disabled when it is empty
+	GitLabWebhookToken string `envconfig:"GITLAB_WEBHOOK_TOKEN"`
+	GitLabWebhookPath  string `envconfig:"GITLAB_WEBHOOK_PATH" default:"/gitlab"`
+	// Token Jenkins passes in the notification URL, the Jenkins endpoint is
+	// disabled when it is empty
+	JenkinsWebhookToken string `envconfig:"JENKINS_WEBHOOK_TOKEN"`
+	JenkinsWebhookPath  string `envconfig:"JENKINS_WEBHOOK_PATH" default:"/jenkins"`
+	// Jenkins to fetch Pipeline stage timings from, and the credentials to
+	// fetch them with
+	JenkinsURL      string `envconfig:"JENKINS_URL"`
+	JenkinsUser     string `envconfig:"JENKINS_USER"`
+	JenkinsAPIToken string `envconfig:"JENKINS_API_TOKEN"`
+	// Watch PipelineRuns in the cluster instead of relying on CloudEvents
+	// delivery alone, in WatchNamespace or all namespaces when it is empty
+	WatchPipelineRuns bool          `envconfig:"WATCH_PIPELINERUNS" default:"false"`
+	WatchNamespace    string        `envconfig:"WATCH_NAMESPACE"`
+	WatchResync       time.Duration `envconfig:"WATCH_RESYNC" default:"10m"`
+	// Repositories, as owner/repo, whose GitHub Actions runs are polled
+	GitHubPollRepos    []string      `envconfig:"GITHUB_POLL_REPOS"`
+	GitHubPollInterval time.Duration `envconfig:"GITHUB_POLL_INTERVAL" default:"10m"`
+	GitHubPollLookback time.Duration `envconfig:"GITHUB_POLL_LOOKBACK" default:"72h"`
+	GitHubAPIURL       string        `envconfig:"GITHUB_API_URL" default:"https://api.github.com"`
+	GitHubToken        string        `envconfig:"API_TOKEN"`
 }
 
 type Data struct {
 	Pipelinerun v1.PipelineRun `json:"pipelineRun"`
+	Taskrun     v1.TaskRun     `json:"taskRun"`
 }
 
-func eventReceiver(ctx context.Context, event cloudevents.Event) error {
-	var dat Data
-	if err := json.Unmarshal(event.DataEncoded, &dat); err != nil {
-		fmt.Println("Ignore")
-	}
-	var client *dynamodb.Client
-	var err error
+// dbClient is the store shared by every event handler.
+var dbClient *dynamodb.Client
 
-	if client, err = newclient(); err != nil {
-		log.Fatalf("failed to create dynamoclient: %s", err.Error())
+// kubeClient reads the children of the PipelineRuns the event handlers
+// store.
+var kubeClient dynamic.Interface
+
+// eventReceiver handles the CloudEvents of every transport. With a queue
+// configured events are acknowledged once persisted and stored by the
+// queue's drain worker.
+func eventReceiver(ctx context.Context, event cloudevents.Event) error {
+	if eventQueue != nil {
+		return eventQueue.enqueue(event)
 	}
-	fmt.Println("Pipleine run", dat.Pipelinerun)
-	InsertRecordInDatabase(dat.Pipelinerun, client)
-	return nil
+	return dispatchEvent(ctx, event)
 }
 
-func InsertRecordInDatabase(object v1.PipelineRun, client *dynamodb.Client) {
+func InsertRecordInDatabase(object v1.PipelineRun, client *dynamodb.Client, kube dynamic.Interface) error {
 	// tables, err := listTables(client, nil)
 	// if err != nil {
 	// 	fmt.Println(err)
@@ -94,121 +153,137 @@ func InsertRecordInDatabase(object v1.PipelineRun, client *dynamodb.Client) {
 	// 		fmt.Println(err)
 	// 	}
 	// }
-	item := PrepareCiBuildData(object)
-	av, err := attributevalue.MarshalMap(item)
+	item, err := PrepareCiBuildData(kube, object)
 	if err != nil {
-		fmt.Println("failed to marshal Record, %w", err)
+		return err
 	}
 	fmt.Println("Inserting in the database")
-	fmt.Println("Response from put api ", putItem(client, "TektonCI", av))
+	return storeBuild(client, "TektonCI", item)
 }
 
-func PrepareCiBuildData(obj v1.PipelineRun) CiBuildPayload {
+// PrepareCiBuildSummary converts the PipelineRun fields into a payload
+// without looking up any of its TaskRuns.
+func PrepareCiBuildSummary(obj v1.PipelineRun) CiBuildPayload {
+	cond := succeededCondition(obj.Status.GetCondition(apis.ConditionSucceeded))
+	source := runSourceInfo(obj.ObjectMeta, obj.Spec.Params)
 	payload := CiBuildPayload{
 		Origin:          "Tekton",
 		OriginalID:      string(obj.UID),
 		Name:            obj.Name,
-		URL:             obj.Status.Provenance.RefSource.URI,
-		CreatedAt:       obj.Status.StartTime.Time.Unix(),
-		StartedAt:       obj.Status.StartTime.Time.Unix(),
-		CompletedAt:     obj.Status.CompletionTime.Time.Unix(),
-		Status:          string(obj.Status.Conditions[0].Type),
-		Conclusion:      string(obj.Status.Conditions[0].Status),
-		RepoURL:         obj.Status.Provenance.RefSource.URI,
-		Commit:          "",
-		PullRequestUrls: make([]string, 0),
-		IsDeployment:    true,
-	}
-	triggeredBy := TriggeredBy{
-		Name:         "Pipelines Operator",
-		Email:        "dummy@redhat.com",
-		AccountId:    "dummy@redhat.com",
-		LastActivity: obj.Status.Conditions[0].LastTransitionTime.Inner.Unix(),
-	}
-	payload.TriggeredBy = triggeredBy
-	var dynamicClientSet *dynamic.DynamicClient
-	var err error
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		fmt.Errorf("Fail to build the k8s config. Error - %s", err)
-		return CiBuildPayload{}
+		URL:             pipelineRunSourceURI(obj),
+		CreatedAt:       runStartTime(obj.Status.StartTime, obj.CreationTimestamp),
+		StartedAt:       unixTime(obj.Status.StartTime),
+		CompletedAt:     runCompletionTime(obj.Status.CompletionTime, cond),
+		Status:          string(cond.Type),
+		Conclusion:      string(cond.Status),
+		RepoURL:         source.repoURL,
+		Commit:          source.commit,
+		PullRequestUrls: source.pullRequestURLs,
+		Branch:          source.branch,
+		EventType:       source.eventType,
+		MissingFields:   missingRunFields(obj.Status.StartTime, obj.Status.CompletionTime, obj.Status.GetCondition(apis.ConditionSucceeded)),
 	}
-	// inorder to create the dynamic Client set
-	dynamicClientSet, err = dynamic.NewForConfig(config)
-	if err != nil {
-		fmt.Errorf("Fail to create the dynamic client set. Errorf - %s", err)
-		return CiBuildPayload{}
+	if payload.URL == "" {
+		payload.MissingFields = append(payload.MissingFields, missingProvenance)
 	}
+	payload.IsDeployment, payload.DeploymentRule = classifyPipelineRun(obj)
+	payload.TriggeredBy = actors.triggeredBy(context.TODO(), obj.ObjectMeta, source, unixTime(&cond.LastTransitionTime.Inner), !cond.IsUnknown())
+	return payload
+}
+
+// PrepareCiBuildData converts the PipelineRun into a payload with a stage
+// for each of its children, read from the cluster with client.
+func PrepareCiBuildData(client dynamic.Interface, obj v1.PipelineRun) (CiBuildPayload, error) {
+	if obj.UID == "" {
+		return CiBuildPayload{}, &conversionError{fmt.Errorf("PipelineRun %s/%s has no UID", obj.Namespace, obj.Name)}
+	}
+	payload := PrepareCiBuildSummary(obj)
 	// if dynamicClientSet, err = GetSecureClientSet(); err != nil {
 	// 	fmt.Println("ERROR ON CREATING CLIENT", err)
 	// 	return CiBuildPayload{}
 	// }
-	genericSchema := schema.GroupVersionResource{
-		Group:    "tekton.dev",
-		Version:  "v1",
-		Resource: "taskruns",
-	}
-	dinterface := dynamicClientSet.Resource(genericSchema).Namespace(obj.Namespace)
-
-	var tasks []Job
-	for _, val := range obj.Status.ChildReferences {
-		if val.Kind == "TaskRun" {
-			var tr *unstructured.Unstructured
-			tr, err = dinterface.Get(context.TODO(), val.Name, metav1.GetOptions{})
-			if err != nil {
-				fmt.Printf("Error retreiving task run %v %v", val.Name, err.Error())
-			}
-			unstructured := tr.UnstructuredContent()
-			var task v1.TaskRun
-			err = runtime.DefaultUnstructuredConverter.FromUnstructured(unstructured, &task)
-			if err != nil {
-				fmt.Printf("Error converting to task run %v", val.Name)
-			}
-			job := Job{
-				StartedAt:   task.Status.StartTime.Time.Unix(),
-				CompletedAt: task.Status.CompletionTime.Time.Unix(),
-				Name:        task.Name,
-				Status:      string(task.Status.Conditions[0].Status),
-				Conclusion:  task.Status.Conditions[0].Reason,
-			}
-			tasks = append(tasks, job)
+	payload.Stages = newStageCollector(context.TODO(), client).stages(obj, "", 0)
+	return payload, nil
+}
+
+// getTaskRun fetches a TaskRun from the cluster, falling back to Tekton
+// Results when it has already been pruned.
+func getTaskRun(ctx context.Context, dinterface dynamic.ResourceInterface, namespace, name string) (*v1.TaskRun, error) {
+	tr, err := dinterface.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if resultsFallback != nil && apierrors.IsNotFound(err) {
+			return resultsFallback.getTaskRun(ctx, namespace, name)
 		}
+		return nil, err
 	}
+	var task v1.TaskRun
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(tr.UnstructuredContent(), &task); err != nil {
+		return nil, fmt.Errorf("Error converting to task run %v: %w", name, err)
+	}
+	return &task, nil
+}
 
-	var stg []Stage
-	stage := Stage{
-		ID:          string(obj.UID),
-		Name:        obj.Name,
-		StartedAt:   obj.Status.StartTime.Time.Unix(),
-		CompletedAt: obj.Status.CompletionTime.Time.Unix(),
-		Status:      string(obj.Status.Conditions[0].Status),
-		Conclusion:  obj.Status.Conditions[0].Reason,
-		URL:         obj.Status.Provenance.RefSource.URI,
-		Jobs:        tasks,
+// unixTime returns the Unix seconds of t, or zero when the time is not set.
+func unixTime(t *metav1.Time) int64 {
+	if t == nil || t.IsZero() {
+		return 0
 	}
-	stg = append(stg, stage)
-	payload.Stages = stg
-	return payload
+	return t.Time.Unix()
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		if err := runBackfill(os.Args[2:]); err != nil {
+			log.Fatalf("backfill failed: %s", err)
+		}
+		return
+	}
+
 	var env envConfig
 	if err := envconfig.Process("", &env); err != nil {
 		log.Fatalf("Failed to process env var: %s", err)
 	}
+	if err := setupResultsFallback(); err != nil {
+		log.Fatalf("failed to configure Tekton Results: %s", err)
+	}
+	if err := setupRecordRules(); err != nil {
+		log.Fatalf("failed to load recording rules: %s", err)
+	}
+	var github *githubClient
+	if env.GitHubToken != "" {
+		github = newGitHubClient(env.GitHubAPIURL, env.GitHubToken)
+	}
+	if err := setupActors(github); err != nil {
+		log.Fatalf("failed to set up actor resolution: %s", err)
+	}
 	log.Print("Starting Event Listener")
 	ctx := context.Background()
 
-	p, err := cloudevents.NewHTTP(cloudevents.WithPort(env.Port), cloudevents.WithPath(env.Path))
+	mux := http.NewServeMux()
+	transport, err := newEventTransport(env, mux)
 	if err != nil {
-		log.Fatalf("failed to create protocol: %s", err.Error())
+		log.Fatalf("failed to create transport: %s", err.Error())
 	}
-	c, err := cloudevents.NewClient(p,
-		cloudevents.WithUUIDs(),
-		cloudevents.WithTimeNow(),
-	)
-	if err != nil {
-		log.Fatalf("failed to create client: %s", err.Error())
+	if env.GitHubWebhookSecret != "" {
+		handler := &githubWebhookHandler{secret: []byte(env.GitHubWebhookSecret), client: github}
+		handler.register()
+		mux.Handle(env.GitHubWebhookPath, handler)
+		log.Printf("accepting GitHub webhooks on :%d%s\n", env.Port, env.GitHubWebhookPath)
+	}
+	if env.GitLabWebhookToken != "" {
+		handler := &gitlabWebhookHandler{token: []byte(env.GitLabWebhookToken)}
+		handler.register()
+		mux.Handle(env.GitLabWebhookPath, handler)
+		log.Printf("accepting GitLab webhooks on :%d%s\n", env.Port, env.GitLabWebhookPath)
+	}
+	if env.JenkinsWebhookToken != "" {
+		jenkins, err := newJenkinsWebhookHandler(env.JenkinsWebhookToken, env.JenkinsURL, env.JenkinsUser, env.JenkinsAPIToken)
+		if err != nil {
+			log.Fatalf("failed to configure Jenkins notifications: %s", err.Error())
+		}
+		jenkins.register()
+		mux.Handle(env.JenkinsWebhookPath, jenkins)
+		log.Printf("accepting Jenkins notifications on :%d%s\n", env.Port, env.JenkinsWebhookPath)
 	}
 
 	var client *dynamodb.Client
@@ -216,6 +291,74 @@ func main() {
 	if client, err = newclient(); err != nil {
 		log.Fatalf("failed to create dynamoclient: %s", err.Error())
 	}
+	dbClient = client
+
+	if kubeClient, err = newDynamicClient(); err != nil {
+		log.Fatalf("failed to create dynamic client: %s", err.Error())
+	}
+
+	store, err := newDeadLetterStore(env.DeadLetterDir, env.DeadLetterTable)
+	if err != nil {
+		log.Fatalf("failed to open dead-letter store: %s", err.Error())
+	}
+	// the metrics port is not exposed outside the cluster, it also serves
+	// the dead-letter API
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/metrics", promhttp.Handler())
+	if store != nil {
+		if env.DeadLetterAPIToken == "" {
+			log.Fatalf("DEAD_LETTER_API_TOKEN is required to serve the dead-letter API")
+		}
+		deadLetters = store
+		handler := &deadLetterHandler{
+			prefix: env.DeadLetterPath,
+			store:  store,
+			token:  []byte(env.DeadLetterAPIToken),
+		}
+		adminMux.Handle(env.DeadLetterPath, handler)
+		adminMux.Handle(env.DeadLetterPath+"/", handler)
+		log.Printf("serving dead letters on :%d%s\n", env.MetricsPort, env.DeadLetterPath)
+	}
+
+	if env.QueueDir != "" {
+		queue, err := newWALQueue(env.QueueDir)
+		if err != nil {
+			log.Fatalf("failed to open queue: %s", err.Error())
+		}
+		eventQueue = queue
+		go queue.drain(ctx, dispatchEvent)
+		log.Printf("queueing events in %s\n", env.QueueDir)
+	}
+
+	if err := transport.start(ctx, eventReceiver); err != nil {
+		log.Fatalf("failed to start %s transport: %s", env.Transport, err.Error())
+	}
+
+	go func() {
+		log.Printf("serving metrics on :%d/metrics\n", env.MetricsPort)
+		if err := http.ListenAndServe(fmt.Sprintf(":%d", env.MetricsPort), adminMux); err != nil {
+			log.Printf("metrics server stopped: %s", err.Error())
+		}
+	}()
+
+	if env.WatchPipelineRuns {
+		watcher := newPipelineRunWatcher(kubeClient, env.WatchNamespace, env.WatchResync)
+		go func() {
+			if err := watcher.run(ctx); err != nil {
+				log.Printf("PipelineRun watcher stopped: %s", err.Error())
+			}
+		}()
+		log.Printf("watching PipelineRuns, resyncing every %s\n", env.WatchResync)
+	}
+
+	if len(env.GitHubPollRepos) > 0 {
+		if github == nil {
+			github = newGitHubClient(env.GitHubAPIURL, env.GitHubToken)
+		}
+		poller := newGitHubPoller(github, env.GitHubPollRepos, env.GitHubPollLookback)
+		go poller.run(ctx, env.GitHubPollInterval)
+		log.Printf("polling GitHub Actions runs of %v every %s\n", env.GitHubPollRepos, env.GitHubPollInterval)
+	}
 
 	go func() {
 		t := time.Tick(60 * time.Minute)
@@ -230,15 +373,21 @@ func main() {
 		}
 	}()
 
-	log.Printf("listening on :%d%s\n", env.Port, env.Path)
-	if err := c.StartReceiver(ctx, eventReceiver); err != nil {
+	log.Printf("listening on :%d\n", env.Port)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", env.Port), mux); err != nil {
 		log.Fatalf("failed to start receiver: %s", err.Error())
 	}
 
 	<-ctx.Done()
 }
 
+// buildOrigins lists the origins of the builds uploaded to Logilica.
+var buildOrigins = []string{"Tekton", "CDEvents", "GitHubActions", "GitLab", "Jenkins"}
+
 func LogilicaUpload(client *dynamodb.Client) {
-	payload := getCiBuildPayload(client)
+	var payload []CiBuildPayload
+	for _, origin := range buildOrigins {
+		payload = append(payload, getCiBuildPayload(client, origin)...)
+	}
 	UploadPlanningData("872a7985dd8a58328dea96015b738c317039fb5a", payload)
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// readFixture decodes the YAML manifest testdata/name into v, failing on
+// fields the Tekton types do not know.
+func readFixture(t *testing.T, name string, v interface{}) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.UnmarshalStrict(data, v); err != nil {
+		t.Fatalf("failed to decode %s: %v", name, err)
+	}
+}
+
+// sameFields compares MissingFields, treating nil and empty as equal.
+func sameFields(got, want []string) bool {
+	if len(got) == 0 && len(want) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(got, want)
+}
+
+func TestPrepareCiBuildSummary(t *testing.T) {
+	tests := []struct {
+		fixture       string
+		conclusion    string
+		startedAt     int64
+		completedAt   int64
+		url           string
+		missingFields []string
+	}{
+		{
+			fixture:     "pipelinerun-succeeded.yaml",
+			conclusion:  "True",
+			startedAt:   1714557600,
+			completedAt: 1714557900,
+			url:         "git+https://github.com/example/pipelines.git",
+		},
+		{
+			fixture:     "pipelinerun-failed.yaml",
+			conclusion:  "False",
+			startedAt:   1714557600,
+			completedAt: 1714557900,
+			url:         "git+https://github.com/example/pipelines.git",
+		},
+		{
+			fixture:     "pipelinerun-cancelled.yaml",
+			conclusion:  "False",
+			startedAt:   1714557600,
+			completedAt: 1714557900,
+			url:         "git+https://github.com/example/pipelines.git",
+		},
+		{
+			fixture:     "pipelinerun-timedout.yaml",
+			conclusion:  "False",
+			startedAt:   1714557600,
+			completedAt: 1714561200,
+			url:         "git+https://github.com/example/pipelines.git",
+		},
+		{
+			fixture:       "pipelinerun-couldnt-get-pipeline.yaml",
+			conclusion:    "False",
+			startedAt:     1714557600,
+			completedAt:   1714557600,
+			missingFields: []string{missingProvenance},
+		},
+		{
+			// completed when the condition last changed
+			fixture:       "pipelinerun-cancelled-pending.yaml",
+			conclusion:    "False",
+			completedAt:   1714557660,
+			missingFields: []string{missingStartTime, missingCompletionTime, missingProvenance},
+		},
+		{
+			fixture:    "pipelinerun-running.yaml",
+			conclusion: "Unknown",
+			startedAt:  1714557600,
+			url:        "git+https://github.com/example/pipelines.git",
+		},
+		{
+			fixture:       "pipelinerun-started.yaml",
+			conclusion:    "Unknown",
+			startedAt:     1714557600,
+			missingFields: []string{missingCondition, missingProvenance},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			var pr v1.PipelineRun
+			readFixture(t, tt.fixture, &pr)
+			payload := PrepareCiBuildSummary(pr)
+			if payload.OriginalID != string(pr.UID) || payload.Name != pr.Name {
+				t.Errorf("build %s %s, want %s %s", payload.OriginalID, payload.Name, pr.UID, pr.Name)
+			}
+			if payload.Status != "Succeeded" || payload.Conclusion != tt.conclusion {
+				t.Errorf("status %s/%s, want Succeeded/%s", payload.Status, payload.Conclusion, tt.conclusion)
+			}
+			if payload.StartedAt != tt.startedAt {
+				t.Errorf("StartedAt = %d, want %d", payload.StartedAt, tt.startedAt)
+			}
+			if payload.CompletedAt != tt.completedAt {
+				t.Errorf("CompletedAt = %d, want %d", payload.CompletedAt, tt.completedAt)
+			}
+			if payload.CreatedAt == 0 {
+				t.Error("CreatedAt is not set")
+			}
+			if payload.URL != tt.url {
+				t.Errorf("URL = %q, want %q", payload.URL, tt.url)
+			}
+			if !sameFields(payload.MissingFields, tt.missingFields) {
+				t.Errorf("MissingFields = %v, want %v", payload.MissingFields, tt.missingFields)
+			}
+		})
+	}
+}
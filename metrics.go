@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// eventsProcessed counts received CloudEvents by type and outcome.
+var eventsProcessed = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "event_listener_events_processed_total",
+		Help: "Number of CloudEvents processed, partitioned by event type and outcome.",
+	},
+	[]string{"type", "outcome"},
+)
+
+// eventsRejected counts CloudEvents rejected by authentication by reason.
+var eventsRejected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "event_listener_events_rejected_total",
+		Help: "Number of CloudEvents rejected by authentication, partitioned by reason.",
+	},
+	[]string{"reason"},
+)
+
+// queueDepth is the number of events waiting in the write-ahead queue.
+var queueDepth = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "event_listener_queue_depth",
+		Help: "Number of received events persisted in the write-ahead queue and not yet stored.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(eventsProcessed, eventsRejected, queueDepth)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"knative.dev/pkg/apis"
+)
+
+var (
+	pipelineRunResource = schema.GroupVersionResource{
+		Group:    "tekton.dev",
+		Version:  "v1",
+		Resource: "pipelineruns",
+	}
+	taskRunResource = schema.GroupVersionResource{
+		Group:    "tekton.dev",
+		Version:  "v1",
+		Resource: "taskruns",
+	}
+	customRunResource = schema.GroupVersionResource{
+		Group:    "tekton.dev",
+		Version:  "v1beta1",
+		Resource: "customruns",
+	}
+)
+
+// newDynamicClient creates a dynamic client from the in-cluster config, or
+// from KUBECONFIG or ~/.kube/config when running outside the cluster, as
+// the backfill command does from a workstation.
+func newDynamicClient() (*dynamic.DynamicClient, error) {
+	config, err := rest.InClusterConfig()
+	if err == rest.ErrNotInCluster {
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{}).ClientConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to build the k8s config: %w", err)
+	}
+	return dynamic.NewForConfig(config)
+}
+
+// pipelineRunWatcher records PipelineRuns as they reach a terminal
+// condition by watching the cluster, so runs are not lost when CloudEvents
+// are not delivered.
+type pipelineRunWatcher struct {
+	client    dynamic.Interface
+	namespace string
+	resync    time.Duration
+
+	mu sync.Mutex
+	// recorded maps the UID of each stored PipelineRun to the resource
+	// version that was stored.
+	recorded map[string]string
+}
+
+func newPipelineRunWatcher(client dynamic.Interface, namespace string, resync time.Duration) *pipelineRunWatcher {
+	return &pipelineRunWatcher{
+		client:    client,
+		namespace: namespace,
+		resync:    resync,
+		recorded:  make(map[string]string),
+	}
+}
+
+// run starts the informer and blocks until the context is done. Every
+// resync replays all PipelineRuns, catching up on any that were missed.
+func (w *pipelineRunWatcher) run(ctx context.Context) error {
+	resource := w.client.Resource(pipelineRunResource).Namespace(w.namespace)
+	lw := &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			return resource.List(ctx, opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			return resource.Watch(ctx, opts)
+		},
+	}
+	informer := cache.NewSharedIndexInformer(lw, &unstructured.Unstructured{}, w.resync, cache.Indexers{})
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.onChange,
+		UpdateFunc: func(_, obj interface{}) { w.onChange(obj) },
+		DeleteFunc: w.onDelete,
+	})
+	if err != nil {
+		return err
+	}
+	informer.Run(ctx.Done())
+	return nil
+}
+
+func (w *pipelineRunWatcher) onChange(obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	var pr v1.PipelineRun
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &pr); err != nil {
+		log.Printf("failed to convert PipelineRun %s/%s: %v", u.GetNamespace(), u.GetName(), err)
+		return
+	}
+	if !isTerminal(pr.Status.GetCondition(apis.ConditionSucceeded)) || isChildPipelineRun(pr) || !recordPipelineRun(pr) {
+		return
+	}
+	uid := string(pr.UID)
+	w.mu.Lock()
+	version, seen := w.recorded[uid]
+	w.mu.Unlock()
+	if seen && version == pr.ResourceVersion {
+		return
+	}
+	if !seen {
+		existing, err := getBuild(dbClient, "TektonCI", "Tekton", uid)
+		if err != nil {
+			log.Printf("failed to look up PipelineRun %s/%s: %v", pr.Namespace, pr.Name, err)
+			return
+		}
+		if existing != nil && existing.CompletedAt != 0 {
+			w.mu.Lock()
+			w.recorded[uid] = pr.ResourceVersion
+			w.mu.Unlock()
+			return
+		}
+	}
+	if err := InsertRecordInDatabase(pr, dbClient, w.client); err != nil {
+		log.Printf("failed to store PipelineRun %s/%s: %v", pr.Namespace, pr.Name, err)
+		eventsProcessed.WithLabelValues("watch.pipelinerun", outcomeFailed).Inc()
+		return
+	}
+	eventsProcessed.WithLabelValues("watch.pipelinerun", outcomeStored).Inc()
+	processed.add(pipelineRunKey(uid))
+	w.mu.Lock()
+	w.recorded[uid] = pr.ResourceVersion
+	w.mu.Unlock()
+}
+
+// onDelete forgets PipelineRuns that were removed from the cluster.
+func (w *pipelineRunWatcher) onDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	delete(w.recorded, string(u.GetUID()))
+	w.mu.Unlock()
+}
+
+// isTerminal reports whether the Succeeded condition is final.
+func isTerminal(cond *apis.Condition) bool {
+	return cond != nil && !cond.IsUnknown()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Annotations Pipelines-as-Code sets on the runs it creates.
+const (
+	pacSHAAnnotation         = "pipelinesascode.tekton.dev/sha"
+	pacRepoURLAnnotation     = "pipelinesascode.tekton.dev/repo-url"
+	pacPullRequestAnnotation = "pipelinesascode.tekton.dev/pull-request"
+	pacEventTypeAnnotation   = "pipelinesascode.tekton.dev/event-type"
+	pacBranchAnnotation      = "pipelinesascode.tekton.dev/branch"
+	pacGitProviderAnnotation = "pipelinesascode.tekton.dev/git-provider"
+)
+
+// Param names conventionally carrying the revision and repository of runs
+// created by Tekton Triggers or by hand, in order of preference.
+var (
+	revisionParams = []string{"git-revision", "revision", "commit-sha", "sha"}
+	repoURLParams  = []string{"git-url", "repo-url", "git-repo-url", "url"}
+)
+
+// sourceInfo is what is known about the change a run built.
+type sourceInfo struct {
+	repoURL         string
+	commit          string
+	branch          string
+	eventType       string
+	pullRequestURLs []string
+}
+
+// runSourceInfo reads the source of a run from its Pipelines-as-Code
+// annotations, falling back to its params.
+func runSourceInfo(meta metav1.ObjectMeta, params v1.Params) sourceInfo {
+	info := sourceInfo{
+		repoURL:         strings.TrimSuffix(meta.Annotations[pacRepoURLAnnotation], ".git"),
+		commit:          meta.Annotations[pacSHAAnnotation],
+		branch:          strings.TrimPrefix(meta.Annotations[pacBranchAnnotation], "refs/heads/"),
+		eventType:       meta.Annotations[pacEventTypeAnnotation],
+		pullRequestURLs: make([]string, 0),
+	}
+	if info.commit == "" {
+		info.commit = paramValue(params, revisionParams)
+	}
+	if info.repoURL == "" {
+		info.repoURL = strings.TrimSuffix(paramValue(params, repoURLParams), ".git")
+	}
+	if number := meta.Annotations[pacPullRequestAnnotation]; number != "" && info.repoURL != "" {
+		info.pullRequestURLs = append(info.pullRequestURLs, pullRequestURL(info.repoURL, meta.Annotations[pacGitProviderAnnotation], number))
+	}
+	return info
+}
+
+// paramValue returns the first non-empty string param out of names.
+func paramValue(params v1.Params, names []string) string {
+	for _, name := range names {
+		for _, param := range params {
+			if param.Name == name && param.Value.StringVal != "" {
+				return param.Value.StringVal
+			}
+		}
+	}
+	return ""
+}
+
+// pullRequestURL returns the web URL of a pull request of the repository
+// on the git provider.
+func pullRequestURL(repoURL, provider, number string) string {
+	switch {
+	case provider == "gitlab" || strings.Contains(repoURL, "gitlab"):
+		return repoURL + "/-/merge_requests/" + number
+	case provider == "bitbucket-cloud" || strings.Contains(repoURL, "bitbucket.org"):
+		return repoURL + "/pull-requests/" + number
+	case provider == "gitea":
+		return repoURL + "/pulls/" + number
+	}
+	return repoURL + "/pull/" + number
+}
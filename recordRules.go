@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline"
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// recordRules decides which Tekton runs are recorded. It is nil when no
+// RULES_FILE is configured, in which case every run is recorded.
+var recordRules *runRules
+
+// runRules are read from a YAML or JSON file such as:
+//
+//	include:
+//	- namespaces: ["team-*"]
+//	exclude:
+//	- pipeline: "^hello-goodbye$"
+//	- selector: "ci.example.com/ignore=true"
+//
+// A run is recorded when it matches any include rule, or there are none,
+// and no exclude rule. The rules also apply to the pipelinerun and taskrun
+// CDEvents, see recordCDEvent.
+type runRules struct {
+	Include []runRule `json:"include"`
+	Exclude []runRule `json:"exclude"`
+}
+
+// runRule matches runs meeting all of its conditions; conditions that are
+// not set match every run.
+type runRule struct {
+	// Namespaces are path.Match patterns, the run must match one of them
+	Namespaces []string `json:"namespaces"`
+	// Selector is a label selector
+	Selector string `json:"selector"`
+	// Annotations must all be present with these values, an empty value
+	// only requires the annotation to be present
+	Annotations map[string]string `json:"annotations"`
+	// Pipeline is a regular expression matched against the Pipeline name
+	Pipeline string `json:"pipeline"`
+
+	selector labels.Selector
+	pipeline *regexp.Regexp
+}
+
+// setupRecordRules loads recordRules from the RULES_FILE and
+// deploymentRules from the DEPLOYMENT_RULES_FILE named in the environment.
+func setupRecordRules() error {
+	if file := os.Getenv("RULES_FILE"); file != "" {
+		rules, err := loadRunRules(file)
+		if err != nil {
+			return err
+		}
+		recordRules = rules
+	}
+	if file := os.Getenv("DEPLOYMENT_RULES_FILE"); file != "" {
+		rules, err := loadDeploymentRules(file)
+		if err != nil {
+			return err
+		}
+		deploymentRules = rules
+	}
+	return nil
+}
+
+// loadRunRules reads and compiles the rules in file.
+func loadRunRules(file string) (*runRules, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+	var rules runRules
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rules: %w", err)
+	}
+	for _, list := range [][]runRule{rules.Include, rules.Exclude} {
+		for i := range list {
+			if err := list[i].compile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &rules, nil
+}
+
+func (r *runRule) compile() error {
+	for _, pattern := range r.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid namespace pattern %q: %w", pattern, err)
+		}
+	}
+	selector, err := labels.Parse(r.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector %q: %w", r.Selector, err)
+	}
+	r.selector = selector
+	if r.Pipeline != "" {
+		re, err := regexp.Compile(r.Pipeline)
+		if err != nil {
+			return fmt.Errorf("invalid pipeline pattern %q: %w", r.Pipeline, err)
+		}
+		r.pipeline = re
+	}
+	return nil
+}
+
+func (r *runRule) matches(meta metav1.ObjectMeta, pipelineName string) bool {
+	if len(r.Namespaces) > 0 {
+		matched := false
+		for _, pattern := range r.Namespaces {
+			if ok, _ := path.Match(pattern, meta.Namespace); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.selector != nil && !r.selector.Matches(labels.Set(meta.Labels)) {
+		return false
+	}
+	for key, value := range r.Annotations {
+		actual, ok := meta.Annotations[key]
+		if !ok || value != "" && actual != value {
+			return false
+		}
+	}
+	return r.pipeline == nil || r.pipeline.MatchString(pipelineName)
+}
+
+// allows reports whether a run with the metadata and Pipeline name is
+// recorded.
+func (r *runRules) allows(meta metav1.ObjectMeta, pipelineName string) bool {
+	if r == nil {
+		return true
+	}
+	included := len(r.Include) == 0
+	for i := range r.Include {
+		if r.Include[i].matches(meta, pipelineName) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for i := range r.Exclude {
+		if r.Exclude[i].matches(meta, pipelineName) {
+			return false
+		}
+	}
+	return true
+}
+
+// recordPipelineRun reports whether the rules allow recording the
+// PipelineRun.
+func recordPipelineRun(obj v1.PipelineRun) bool {
+	return recordRules.allows(obj.ObjectMeta, pipelineName(obj))
+}
+
+// recordTaskRun reports whether the rules allow recording the standalone
+// TaskRun, whose Task name stands in for the Pipeline name.
+func recordTaskRun(obj v1.TaskRun) bool {
+	name := obj.Labels[pipeline.TaskLabelKey]
+	if name == "" && obj.Spec.TaskRef != nil {
+		name = obj.Spec.TaskRef.Name
+	}
+	return recordRules.allows(obj.ObjectMeta, name)
+}
+
+// pipelineName returns the name of the Pipeline the PipelineRun runs, or
+// an empty string for an embedded Pipeline.
+func pipelineName(obj v1.PipelineRun) string {
+	if name := obj.Labels[pipeline.PipelineLabelKey]; name != "" {
+		return name
+	}
+	if obj.Spec.PipelineRef != nil {
+		return obj.Spec.PipelineRef.Name
+	}
+	return ""
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func writeRules(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// useRecordRules installs the rules for the duration of the test.
+func useRecordRules(t *testing.T, content string) {
+	t.Helper()
+	rules, err := loadRunRules(writeRules(t, content))
+	if err != nil {
+		t.Fatalf("loadRunRules: %v", err)
+	}
+	recordRules = rules
+	t.Cleanup(func() { recordRules = nil })
+}
+
+func TestRunRulesAllows(t *testing.T) {
+	run := func(namespace string, labels, annotations map[string]string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: "run", Namespace: namespace, Labels: labels, Annotations: annotations}
+	}
+	tests := []struct {
+		name     string
+		rules    string
+		meta     metav1.ObjectMeta
+		pipeline string
+		want     bool
+	}{
+		{name: "no rules", meta: run("ci", nil, nil), want: true},
+		{
+			name:  "included namespace",
+			rules: `include: [{namespaces: ["team-*", "ci"]}]`,
+			meta:  run("team-a", nil, nil), want: true,
+		},
+		{
+			name:  "namespace not included",
+			rules: `include: [{namespaces: ["team-*", "ci"]}]`,
+			meta:  run("sandbox", nil, nil),
+		},
+		{
+			name:  "any include rule",
+			rules: `include: [{namespaces: ["ci"]}, {selector: "app=api"}]`,
+			meta:  run("sandbox", map[string]string{"app": "api"}, nil), want: true,
+		},
+		{
+			name:  "all conditions of a rule",
+			rules: `include: [{namespaces: ["ci"], pipeline: "^build"}]`,
+			meta:  run("ci", nil, nil), pipeline: "deploy",
+		},
+		{
+			name:  "excluded pipeline",
+			rules: `exclude: [{pipeline: "^hello-goodbye$"}]`,
+			meta:  run("ci", nil, nil), pipeline: "hello-goodbye",
+		},
+		{
+			name:  "other pipeline",
+			rules: `exclude: [{pipeline: "^hello-goodbye$"}]`,
+			meta:  run("ci", nil, nil), pipeline: "hello-goodbye-2", want: true,
+		},
+		{
+			name:  "embedded pipeline",
+			rules: `include: [{pipeline: "."}]`,
+			meta:  run("ci", nil, nil),
+		},
+		{
+			name:  "excluded by selector",
+			rules: `exclude: [{selector: "ci.example.com/ignore=true"}]`,
+			meta:  run("ci", map[string]string{"ci.example.com/ignore": "true"}, nil),
+		},
+		{
+			name:  "included but excluded",
+			rules: "include: [{namespaces: [ci]}]\nexclude: [{selector: \"ci.example.com/ignore\"}]",
+			meta:  run("ci", map[string]string{"ci.example.com/ignore": ""}, nil),
+		},
+		{
+			name:  "annotation present",
+			rules: `exclude: [{annotations: {"ci.example.com/skip": ""}}]`,
+			meta:  run("ci", nil, map[string]string{"ci.example.com/skip": "yes"}),
+		},
+		{
+			name:  "annotation value",
+			rules: `exclude: [{annotations: {"ci.example.com/skip": "true"}}]`,
+			meta:  run("ci", nil, map[string]string{"ci.example.com/skip": "false"}), want: true,
+		},
+		{
+			name:  "annotation missing",
+			rules: `include: [{annotations: {"ci.example.com/record": ""}}]`,
+			meta:  run("ci", nil, nil),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rules *runRules
+			if tt.rules != "" {
+				var err error
+				if rules, err = loadRunRules(writeRules(t, tt.rules)); err != nil {
+					t.Fatalf("loadRunRules: %v", err)
+				}
+			}
+			if got := rules.allows(tt.meta, tt.pipeline); got != tt.want {
+				t.Errorf("allows = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRunRulesErrors(t *testing.T) {
+	tests := map[string]string{
+		"namespace pattern": `include: [{namespaces: ["team-["]}]`,
+		"selector":          `exclude: [{selector: "app in (api"}]`,
+		"pipeline":          `exclude: [{pipeline: "(build"}]`,
+		"unknown field":     `exclude: [{namespace: ci}]`,
+	}
+	for name, rules := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadRunRules(writeRules(t, rules)); err == nil {
+				t.Error("invalid rules were loaded")
+			}
+		})
+	}
+}
+
+func cdEvent(t *testing.T, id, kind string, subject map[string]interface{}) cloudevents.Event {
+	t.Helper()
+	event := testEvent(id, cdEventPrefix+kind+".0.1.1")
+	event.SetTime(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC))
+	err := event.SetData(cloudevents.ApplicationJSON, map[string]interface{}{
+		"context": map[string]interface{}{"id": id, "source": "/tekton"},
+		"subject": subject,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestRecordCDEvent(t *testing.T) {
+	useRecordRules(t, "include: [{namespaces: [\"team-*\"]}]\nexclude: [{pipeline: \"^nightly$\"}]")
+	pipelineRun := func(id, namespace, pipeline string) map[string]interface{} {
+		return map[string]interface{}{
+			"id": id, "source": namespace, "content": map[string]interface{}{"pipelineName": pipeline},
+		}
+	}
+	taskRun := func(id, namespace, task string, parent map[string]interface{}) map[string]interface{} {
+		content := map[string]interface{}{"taskName": task}
+		if parent != nil {
+			content["pipelineRun"] = parent
+		}
+		return map[string]interface{}{"id": id, "source": namespace, "content": content}
+	}
+
+	tests := []struct {
+		name    string
+		kind    string
+		subject map[string]interface{}
+		// existing is stored before the event is handled
+		existing *CiBuildPayload
+		// stored names the build that must be stored, if any
+		stored string
+	}{
+		{name: "pipelinerun in an included namespace", kind: "pipelinerun.started", subject: pipelineRun("build-1", "team-a", "build"), stored: "build-1"},
+		{name: "pipelinerun in another namespace", kind: "pipelinerun.started", subject: pipelineRun("build-2", "sandbox", "build")},
+		{name: "finished pipelinerun excluded by name", kind: "pipelinerun.finished", subject: pipelineRun("nightly-1", "team-a", "nightly")},
+		{name: "standalone taskrun named by its task", kind: "taskrun.started", subject: taskRun("lint-1", "team-a", "lint", nil), stored: "lint-1"},
+		{name: "standalone taskrun excluded by its task", kind: "taskrun.finished", subject: taskRun("nightly-2", "team-a", "nightly", nil)},
+		{
+			name:     "taskrun of a recorded pipelinerun",
+			kind:     "taskrun.started",
+			subject:  taskRun("build-1-clone", "team-a", "clone", map[string]interface{}{"id": "build-1", "source": "team-a"}),
+			existing: &CiBuildPayload{Origin: "CDEvents", OriginalID: "build-1", Name: "build"},
+			stored:   "build-1",
+		},
+		{
+			name:    "taskrun of a pipelinerun in another namespace",
+			kind:    "taskrun.started",
+			subject: taskRun("build-3-clone", "sandbox", "clone", map[string]interface{}{"id": "build-3", "source": "sandbox"}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeStore(t)
+			if tt.existing != nil {
+				if err := storeBuild(dbClient, "TektonCI", *tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+			event := cdEvent(t, "event-"+tt.subject["id"].(string), tt.kind, tt.subject)
+			outcome, err := handleCDEvent(context.Background(), event)
+			if err != nil {
+				t.Fatalf("handleCDEvent: %v", err)
+			}
+			if tt.stored == "" {
+				if outcome != outcomeIgnored || len(fake.items) != 0 && tt.existing == nil {
+					t.Errorf("outcome %s with %d items stored, want the event ignored", outcome, len(fake.items))
+				}
+				return
+			}
+			if outcome != outcomeStored {
+				t.Errorf("outcome = %s, want %s", outcome, outcomeStored)
+			}
+			if fake.get("TektonCI", "CDEvents", tt.stored) == nil {
+				t.Errorf("build %s was not stored", tt.stored)
+			}
+		})
+	}
+}
+
+func TestRecordCDEventTaskRunOfExcludedPipeline(t *testing.T) {
+	useRecordRules(t, `exclude: [{pipeline: "^nightly$"}]`)
+	fake := useFakeStore(t)
+	if err := storeBuild(dbClient, "TektonCI", CiBuildPayload{Origin: "CDEvents", OriginalID: "nightly-1", Name: "nightly"}); err != nil {
+		t.Fatal(err)
+	}
+	subject := map[string]interface{}{
+		"id": "nightly-1-clone", "source": "ci",
+		"content": map[string]interface{}{"taskName": "clone", "pipelineRun": map[string]interface{}{"id": "nightly-1", "source": "ci"}},
+	}
+	outcome, err := handleCDEvent(context.Background(), cdEvent(t, "event-1", "taskrun.finished", subject))
+	if err != nil || outcome != outcomeIgnored {
+		t.Fatalf("outcome = %s, %v, want %s", outcome, err, outcomeIgnored)
+	}
+	if stages := fake.get("TektonCI", "CDEvents", "nightly-1")["stages"]; stages != nil && strings.Contains(string(stages), "clone") {
+		t.Errorf("the taskrun was recorded on the excluded pipelinerun: %s", stages)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tektoncd/pipeline/pkg/apis/pipeline"
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"knative.dev/pkg/apis"
+)
+
+// Names recorded in MissingFields for data a run did not provide.
+const (
+	missingCondition      = "condition"
+	missingStartTime      = "startTime"
+	missingCompletionTime = "completionTime"
+	missingProvenance     = "provenance"
+	// missingTaskRun, missingPipelineRun and missingCustomRun mark child
+	// runs that could not be fetched
+	missingTaskRun     = "taskRun"
+	missingPipelineRun = "pipelineRun"
+	missingCustomRun   = "customRun"
+)
+
+// isStandaloneTaskRun reports whether the TaskRun was created directly
+// rather than by a PipelineRun.
+func isStandaloneTaskRun(obj v1.TaskRun) bool {
+	if _, ok := obj.Labels[pipeline.PipelineRunLabelKey]; ok {
+		return false
+	}
+	for _, ref := range obj.OwnerReferences {
+		if ref.Kind == pipeline.PipelineRunControllerName {
+			return false
+		}
+	}
+	return true
+}
+
+// PrepareTaskRunCiBuildData converts a standalone TaskRun into a build with
+// a single stage for the TaskRun and one job per step.
+func PrepareTaskRunCiBuildData(obj v1.TaskRun) CiBuildPayload {
+	cond := succeededCondition(obj.Status.GetCondition(apis.ConditionSucceeded))
+	source := runSourceInfo(obj.ObjectMeta, obj.Spec.Params)
+	payload := CiBuildPayload{
+		Origin:          "Tekton",
+		OriginalID:      string(obj.UID),
+		Name:            obj.Name,
+		URL:             taskRunSourceURI(obj),
+		CreatedAt:       runStartTime(obj.Status.StartTime, obj.CreationTimestamp),
+		StartedAt:       unixTime(obj.Status.StartTime),
+		CompletedAt:     runCompletionTime(obj.Status.CompletionTime, cond),
+		Status:          string(cond.Type),
+		Conclusion:      string(cond.Status),
+		RepoURL:         source.repoURL,
+		Commit:          source.commit,
+		PullRequestUrls: source.pullRequestURLs,
+		Branch:          source.branch,
+		EventType:       source.eventType,
+		MissingFields:   missingRunFields(obj.Status.StartTime, obj.Status.CompletionTime, obj.Status.GetCondition(apis.ConditionSucceeded)),
+	}
+	if payload.URL == "" {
+		payload.MissingFields = append(payload.MissingFields, missingProvenance)
+	}
+	payload.IsDeployment, payload.DeploymentRule = classifyTaskRun(obj)
+	payload.TriggeredBy = actors.triggeredBy(context.TODO(), obj.ObjectMeta, source, unixTime(&cond.LastTransitionTime.Inner), !cond.IsUnknown())
+
+	payload.Stages = []Stage{taskRunToStage(obj.Name, obj, false)}
+	return payload
+}
+
+// taskRunToStage converts a TaskRun into a stage named name with one job
+// per step. When the TaskRun was retried, the steps of every attempt are
+// listed, each attempt preceded by a job spanning the whole attempt, so
+// attempts can be compared. TaskRuns that are still pending have no start
+// time or condition yet.
+func taskRunToStage(name string, obj v1.TaskRun, finally bool) Stage {
+	cond := succeededCondition(obj.Status.GetCondition(apis.ConditionSucceeded))
+	stage := Stage{
+		ID:            string(obj.UID),
+		Name:          name,
+		StartedAt:     unixTime(obj.Status.StartTime),
+		CompletedAt:   runCompletionTime(obj.Status.CompletionTime, cond),
+		Status:        string(cond.Status),
+		Conclusion:    cond.Reason,
+		URL:           taskRunSourceURI(obj),
+		Finally:       finally,
+		MissingFields: missingRunFields(obj.Status.StartTime, obj.Status.CompletionTime, obj.Status.GetCondition(apis.ConditionSucceeded)),
+	}
+	stage.Retries = len(obj.Status.RetriesStatus)
+	stage.Attempt = stage.Retries + 1
+	for i, retry := range obj.Status.RetriesStatus {
+		stage.Jobs = append(stage.Jobs, attemptJobs(i+1, retry)...)
+	}
+	if stage.Retries > 0 {
+		stage.Jobs = append(stage.Jobs, attemptJobs(stage.Attempt, obj.Status)...)
+		return stage
+	}
+	for _, step := range obj.Status.Steps {
+		job := stepToJob(step)
+		job.Attempt = stage.Attempt
+		stage.Jobs = append(stage.Jobs, job)
+	}
+	return stage
+}
+
+// attemptJobs converts an attempt of a retried TaskRun into a job spanning
+// the whole attempt, whose reason tells how the attempt ended, followed by
+// one job per step of the attempt.
+func attemptJobs(attempt int, status v1.TaskRunStatus) []Job {
+	cond := succeededCondition(status.GetCondition(apis.ConditionSucceeded))
+	jobs := []Job{{
+		Name:          fmt.Sprintf("attempt-%d", attempt),
+		StartedAt:     unixTime(status.StartTime),
+		CompletedAt:   runCompletionTime(status.CompletionTime, cond),
+		Status:        string(cond.Status),
+		Conclusion:    cond.Reason,
+		Attempt:       attempt,
+		MissingFields: missingRunFields(status.StartTime, status.CompletionTime, status.GetCondition(apis.ConditionSucceeded)),
+	}}
+	for _, step := range status.Steps {
+		job := stepToJob(step)
+		job.Attempt = attempt
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// finallyTasks returns the names of the finally tasks of the PipelineRun.
+func finallyTasks(obj v1.PipelineRun) map[string]bool {
+	spec := obj.Status.PipelineSpec
+	if spec == nil {
+		spec = obj.Spec.PipelineSpec
+	}
+	finally := make(map[string]bool)
+	if spec != nil {
+		for _, task := range spec.Finally {
+			finally[task.Name] = true
+		}
+	}
+	return finally
+}
+
+// stepToJob converts the state of a single TaskRun step into a job.
+func stepToJob(step v1.StepState) Job {
+	job := Job{Name: step.Name}
+	switch {
+	case step.Terminated != nil:
+		job.StartedAt = step.Terminated.StartedAt.Unix()
+		job.CompletedAt = step.Terminated.FinishedAt.Unix()
+		job.Status = string(corev1.ConditionTrue)
+		exitCode := step.Terminated.ExitCode
+		job.ExitCode = &exitCode
+		if step.Terminated.ExitCode != 0 {
+			job.Status = string(corev1.ConditionFalse)
+		}
+		job.Conclusion = step.Terminated.Reason
+		if step.TerminationReason != "" {
+			job.Conclusion = step.TerminationReason
+		}
+	case step.Running != nil:
+		job.StartedAt = step.Running.StartedAt.Unix()
+		job.Status = string(corev1.ConditionUnknown)
+		job.Conclusion = "Running"
+	case step.Waiting != nil:
+		job.Status = string(corev1.ConditionUnknown)
+		job.Conclusion = step.Waiting.Reason
+	}
+	return job
+}
+
+// taskRunSourceURI returns where the Task definition came from, if known.
+func taskRunSourceURI(obj v1.TaskRun) string {
+	if obj.Status.Provenance == nil || obj.Status.Provenance.RefSource == nil {
+		return ""
+	}
+	return obj.Status.Provenance.RefSource.URI
+}
+
+// pipelineRunSourceURI returns where the Pipeline definition came from, if
+// known.
+func pipelineRunSourceURI(obj v1.PipelineRun) string {
+	if obj.Status.Provenance == nil || obj.Status.Provenance.RefSource == nil {
+		return ""
+	}
+	return obj.Status.Provenance.RefSource.URI
+}
+
+// runStartTime returns when a run started, falling back to its creation for
+// runs cancelled or timed out before they started.
+func runStartTime(start *metav1.Time, created metav1.Time) int64 {
+	if t := unixTime(start); t != 0 {
+		return t
+	}
+	return unixTime(&created)
+}
+
+// runCompletionTime returns when a run completed. Finished runs without a
+// completion time, such as runs cancelled before they started, are taken
+// to have completed when their condition last changed.
+func runCompletionTime(completion *metav1.Time, cond apis.Condition) int64 {
+	if t := unixTime(completion); t != 0 || cond.IsUnknown() {
+		return t
+	}
+	return unixTime(&cond.LastTransitionTime.Inner)
+}
+
+// missingRunFields lists the status fields a run should have but lacks.
+// Runs that have not finished are not expected to have every field yet.
+func missingRunFields(start, completion *metav1.Time, cond *apis.Condition) []string {
+	if cond == nil {
+		return []string{missingCondition}
+	}
+	var missing []string
+	if isTerminal(cond) && start == nil {
+		missing = append(missing, missingStartTime)
+	}
+	if isTerminal(cond) && completion == nil {
+		missing = append(missing, missingCompletionTime)
+	}
+	return missing
+}
+
+// succeededCondition returns the Succeeded condition, or an empty condition
+// when the controller has not set one yet.
+func succeededCondition(cond *apis.Condition) apis.Condition {
+	if cond == nil {
+		return apis.Condition{Type: apis.ConditionSucceeded, Status: corev1.ConditionUnknown}
+	}
+	return *cond
+}
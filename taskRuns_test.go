@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// wantJob is the part of a job the TaskRun tests check.
+type wantJob struct {
+	name       string
+	status     string
+	conclusion string
+	attempt    int
+}
+
+func TestPrepareTaskRunCiBuildData(t *testing.T) {
+	tests := []struct {
+		fixture       string
+		conclusion    string
+		reason        string
+		completedAt   int64
+		missingFields []string
+		jobs          []wantJob
+	}{
+		{
+			fixture:     "taskrun-succeeded.yaml",
+			conclusion:  "True",
+			reason:      "Succeeded",
+			completedAt: 1714557900,
+			jobs: []wantJob{
+				{name: "fetch", status: "True", conclusion: "Completed", attempt: 1},
+				{name: "lint", status: "True", conclusion: "Completed", attempt: 1},
+			},
+		},
+		{
+			fixture:       "taskrun-failed.yaml",
+			conclusion:    "False",
+			reason:        "Failed",
+			completedAt:   1714557900,
+			missingFields: []string{missingProvenance},
+			jobs: []wantJob{
+				{name: "attempt-1", status: "False", conclusion: "Failed", attempt: 1},
+				{name: "test", status: "False", conclusion: "Error", attempt: 1},
+				{name: "attempt-2", status: "False", conclusion: "Failed", attempt: 2},
+				{name: "test", status: "False", conclusion: "Error", attempt: 2},
+			},
+		},
+		{
+			fixture:       "taskrun-timedout.yaml",
+			conclusion:    "False",
+			reason:        "TaskRunTimeout",
+			completedAt:   1714561200,
+			missingFields: []string{missingProvenance},
+			jobs: []wantJob{
+				{name: "e2e", status: "False", conclusion: "TimeoutExceeded", attempt: 1},
+			},
+		},
+		{
+			fixture:       "taskrun-cancelled.yaml",
+			conclusion:    "False",
+			reason:        "TaskRunCancelled",
+			completedAt:   1714557660,
+			missingFields: []string{missingProvenance},
+			jobs: []wantJob{
+				{name: "e2e", status: "False", conclusion: "TaskRunCancelled", attempt: 1},
+			},
+		},
+		{
+			fixture:       "taskrun-pending.yaml",
+			conclusion:    "Unknown",
+			missingFields: []string{missingCondition, missingProvenance},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			var tr v1.TaskRun
+			readFixture(t, tt.fixture, &tr)
+			if !isStandaloneTaskRun(tr) {
+				t.Fatal("fixture is not a standalone TaskRun")
+			}
+			payload := PrepareTaskRunCiBuildData(tr)
+			if payload.Status != "Succeeded" || payload.Conclusion != tt.conclusion {
+				t.Errorf("status %s/%s, want Succeeded/%s", payload.Status, payload.Conclusion, tt.conclusion)
+			}
+			if payload.CompletedAt != tt.completedAt {
+				t.Errorf("CompletedAt = %d, want %d", payload.CompletedAt, tt.completedAt)
+			}
+			if !sameFields(payload.MissingFields, tt.missingFields) {
+				t.Errorf("MissingFields = %v, want %v", payload.MissingFields, tt.missingFields)
+			}
+			if len(payload.Stages) != 1 {
+				t.Fatalf("got %d stages, want 1", len(payload.Stages))
+			}
+			stage := payload.Stages[0]
+			if stage.Status != tt.conclusion || stage.Conclusion != tt.reason {
+				t.Errorf("stage status %s/%s, want %s/%s", stage.Status, stage.Conclusion, tt.conclusion, tt.reason)
+			}
+			if stage.CompletedAt != tt.completedAt {
+				t.Errorf("stage CompletedAt = %d, want %d", stage.CompletedAt, tt.completedAt)
+			}
+			if len(stage.Jobs) != len(tt.jobs) {
+				t.Fatalf("got %d jobs, want %d", len(stage.Jobs), len(tt.jobs))
+			}
+			for i, want := range tt.jobs {
+				job := stage.Jobs[i]
+				got := wantJob{name: job.Name, status: job.Status, conclusion: job.Conclusion, attempt: job.Attempt}
+				if got != want {
+					t.Errorf("job %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestTaskRunToStageWithoutStatus checks that runs missing their status,
+// as sent by some event sources, are still converted.
+func TestTaskRunToStageWithoutStatus(t *testing.T) {
+	var tr v1.TaskRun
+	readFixture(t, "taskrun-pending.yaml", &tr)
+	tr.Status.RetriesStatus = []v1.TaskRunStatus{{}}
+	stage := taskRunToStage("lint", tr, true)
+	if stage.Name != "lint" || !stage.Finally {
+		t.Errorf("stage %s finally=%v, want lint finally=true", stage.Name, stage.Finally)
+	}
+	if stage.Status != "Unknown" || stage.StartedAt != 0 || stage.CompletedAt != 0 {
+		t.Errorf("stage %s started %d completed %d, want Unknown and no times", stage.Status, stage.StartedAt, stage.CompletedAt)
+	}
+	if len(stage.Jobs) != 2 || stage.Jobs[0].Attempt != 1 || stage.Jobs[1].Attempt != 2 || !sameFields(stage.Jobs[0].MissingFields, []string{missingCondition}) {
+		t.Errorf("jobs = %+v, want two attempts without a condition", stage.Jobs)
+	}
+}
+
+func TestFinallyTasks(t *testing.T) {
+	spec := func(finally ...string) *v1.PipelineSpec {
+		spec := &v1.PipelineSpec{Tasks: []v1.PipelineTask{{Name: "build"}}}
+		for _, name := range finally {
+			spec.Finally = append(spec.Finally, v1.PipelineTask{Name: name})
+		}
+		return spec
+	}
+	tests := []struct {
+		name   string
+		spec   *v1.PipelineSpec
+		status *v1.PipelineSpec
+		want   map[string]bool
+	}{
+		{name: "no spec", want: map[string]bool{}},
+		{name: "embedded spec", spec: spec("notify"), want: map[string]bool{"notify": true}},
+		{name: "resolved spec", spec: spec("notify"), status: spec("cleanup", "report"), want: map[string]bool{"cleanup": true, "report": true}},
+		{name: "no finally tasks", status: spec(), want: map[string]bool{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pr v1.PipelineRun
+			pr.Spec.PipelineSpec = tt.spec
+			pr.Status.PipelineSpec = tt.status
+			if got := finallyTasks(pr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("finallyTasks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStepToJob(t *testing.T) {
+	started := metav1.NewTime(testRunStart.Time)
+	finished := metav1.NewTime(testRunEnd.Time)
+	terminated := func(exitCode int32, reason string) corev1.ContainerState {
+		return corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+			ExitCode: exitCode, Reason: reason, StartedAt: started, FinishedAt: finished,
+		}}
+	}
+	exitCode := func(code int32) *int32 { return &code }
+	tests := []struct {
+		name string
+		step v1.StepState
+		want Job
+	}{
+		{
+			name: "succeeded",
+			step: v1.StepState{Name: "build", ContainerState: terminated(0, "Completed")},
+			want: Job{Name: "build", StartedAt: started.Unix(), CompletedAt: finished.Unix(), Status: "True", Conclusion: "Completed", ExitCode: exitCode(0)},
+		},
+		{
+			name: "failed",
+			step: v1.StepState{Name: "test", ContainerState: terminated(2, "Error")},
+			want: Job{Name: "test", StartedAt: started.Unix(), CompletedAt: finished.Unix(), Status: "False", Conclusion: "Error", ExitCode: exitCode(2)},
+		},
+		{
+			name: "timed out",
+			step: v1.StepState{Name: "test", ContainerState: terminated(1, "Error"), TerminationReason: "TimeoutExceeded"},
+			want: Job{Name: "test", StartedAt: started.Unix(), CompletedAt: finished.Unix(), Status: "False", Conclusion: "TimeoutExceeded", ExitCode: exitCode(1)},
+		},
+		{
+			name: "running",
+			step: v1.StepState{Name: "deploy", ContainerState: corev1.ContainerState{Running: &corev1.ContainerStateRunning{StartedAt: started}}},
+			want: Job{Name: "deploy", StartedAt: started.Unix(), Status: "Unknown", Conclusion: "Running"},
+		},
+		{
+			name: "waiting",
+			step: v1.StepState{Name: "deploy", ContainerState: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "PodInitializing"}}},
+			want: Job{Name: "deploy", Status: "Unknown", Conclusion: "PodInitializing"},
+		},
+		{
+			name: "no state",
+			step: v1.StepState{Name: "deploy"},
+			want: Job{Name: "deploy"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stepToJob(tt.step); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stepToJob = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestStagesOfPipelineRun checks that each task becomes a stage, in the
+// order of the child references, with a job per step, and that finally
+// tasks and the stages of child PipelineRuns are marked.
+func TestStagesOfPipelineRun(t *testing.T) {
+	withSteps := func(tr *v1.TaskRun, steps ...string) *v1.TaskRun {
+		for _, step := range steps {
+			tr.Status.Steps = append(tr.Status.Steps, v1.StepState{Name: step, ContainerState: corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{StartedAt: testRunStart, FinishedAt: testRunEnd, Reason: "Completed"},
+			}})
+		}
+		return tr
+	}
+	top := testPipelineRun("release",
+		childRef("TaskRun", "release-clone", "clone"),
+		childRef("PipelineRun", "release-test", "test"),
+		childRef("TaskRun", "release-build", "build"),
+		childRef("TaskRun", "release-notify", "notify"))
+	top.Status.PipelineSpec = &v1.PipelineSpec{
+		Tasks:   []v1.PipelineTask{{Name: "clone"}, {Name: "test"}, {Name: "build"}},
+		Finally: []v1.PipelineTask{{Name: "notify"}},
+	}
+	child := testPipelineRun("release-test", childRef("TaskRun", "release-test-unit", "unit"))
+	// the child's finally task shares its name with a task of the parent
+	child.Status.PipelineSpec = &v1.PipelineSpec{
+		Tasks:   []v1.PipelineTask{{Name: "unit"}},
+		Finally: []v1.PipelineTask{{Name: "build"}},
+	}
+	kube := newFakeKube(t,
+		withSteps(testTaskRun("release-clone"), "clone"),
+		child,
+		withSteps(testTaskRun("release-test-unit"), "prepare", "unit"),
+		withSteps(testTaskRun("release-build"), "build", "push"),
+		withSteps(testTaskRun("release-notify"), "notify"),
+	)
+
+	type wantStage struct {
+		name, parent string
+		finally      bool
+		jobs         []string
+	}
+	want := []wantStage{
+		{name: "clone", jobs: []string{"clone"}},
+		{name: "test"},
+		{name: "test/unit", parent: "test", jobs: []string{"prepare", "unit"}},
+		{name: "build", jobs: []string{"build", "push"}},
+		{name: "notify", finally: true, jobs: []string{"notify"}},
+	}
+	var got []wantStage
+	for _, stage := range newStageCollector(context.Background(), kube).stages(*top, "", 0) {
+		s := wantStage{name: stage.Name, parent: stage.Parent, finally: stage.Finally}
+		for _, job := range stage.Jobs {
+			if job.Status != "True" || job.Attempt != 1 {
+				t.Errorf("job %s of stage %s is %s in attempt %d, want True in attempt 1", job.Name, stage.Name, job.Status, job.Attempt)
+			}
+			s.jobs = append(s.jobs, job.Name)
+		}
+		got = append(got, s)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stages =\n%+v\nwant\n%+v", got, want)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+)
+
+// Record data types stored by Tekton Results for v1 runs.
+const (
+	resultsTaskRunType     = "tekton.dev/v1.TaskRun"
+	resultsPipelineRunType = "tekton.dev/v1.PipelineRun"
+)
+
+// errResultsNotFound is returned for runs Tekton Results has no record of.
+var errResultsNotFound = errors.New("not found in Tekton Results")
+
+// resultsFallback is consulted for runs that were pruned from the cluster.
+// It is nil when no Tekton Results API is configured.
+var resultsFallback *resultsClient
+
+// resultsConfig configures the Tekton Results fallback.
+type resultsConfig struct {
+	// Base URL of the Results API, the fallback is disabled when it is empty
+	URL       string `envconfig:"RESULTS_API_URL"`
+	TokenFile string `envconfig:"RESULTS_TOKEN_FILE" default:"/var/run/secrets/kubernetes.io/serviceaccount/token"`
+	CAFile    string `envconfig:"RESULTS_CA_FILE"`
+}
+
+// setupResultsFallback creates resultsFallback from the environment.
+func setupResultsFallback() error {
+	var cfg resultsConfig
+	if err := envconfig.Process("", &cfg); err != nil {
+		return err
+	}
+	if cfg.URL == "" {
+		return nil
+	}
+	client, err := newResultsClient(cfg.URL, cfg.TokenFile, cfg.CAFile)
+	if err != nil {
+		return err
+	}
+	resultsFallback = client
+	return nil
+}
+
+// resultsClient reads archived runs from the Tekton Results REST API.
+type resultsClient struct {
+	baseURL    string
+	tokenFile  string
+	httpClient *http.Client
+}
+
+// ResultsRecord is a record returned by the Results API. The value holds
+// the JSON of the archived run.
+type ResultsRecord struct {
+	Name       string    `json:"name"`
+	UID        string    `json:"uid"`
+	CreateTime time.Time `json:"createTime"`
+	Data       struct {
+		Type  string `json:"type"`
+		Value []byte `json:"value"`
+	} `json:"data"`
+}
+
+type ResultsRecordList struct {
+	Records       []ResultsRecord `json:"records"`
+	NextPageToken string          `json:"nextPageToken"`
+}
+
+// newResultsClient creates a client for the Results API at baseURL,
+// authenticating with the token in tokenFile and trusting caFile if set.
+func newResultsClient(baseURL, tokenFile, caFile string) (*resultsClient, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Results CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &resultsClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		tokenFile:  tokenFile,
+		httpClient: &http.Client{Timeout: 30 * time.Second, Transport: transport},
+	}, nil
+}
+
+// listRecords pages through the records of the namespace matching the CEL
+// filter. An empty namespace lists records of all namespaces.
+func (c *resultsClient) listRecords(ctx context.Context, namespace, filter string) ([]ResultsRecord, error) {
+	if namespace == "" {
+		namespace = "-"
+	}
+	var records []ResultsRecord
+	pageToken := ""
+	for {
+		query := url.Values{}
+		query.Set("filter", filter)
+		query.Set("page_size", "100")
+		if pageToken != "" {
+			query.Set("page_token", pageToken)
+		}
+		endpoint := fmt.Sprintf("%s/apis/results.tekton.dev/v1alpha2/parents/%s/results/-/records?%s", c.baseURL, url.PathEscape(namespace), query.Encode())
+		var page ResultsRecordList
+		if err := c.getJSON(ctx, endpoint, &page); err != nil {
+			return nil, err
+		}
+		records = append(records, page.Records...)
+		if page.NextPageToken == "" {
+			return records, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (c *resultsClient) getJSON(ctx context.Context, endpoint string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if c.tokenFile != "" {
+		token, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read Results token: %w", err)
+		}
+		req.Header.Add("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("GET %s: %w", endpoint, errResultsNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// getTaskRun returns the archived TaskRun with the given name.
+func (c *resultsClient) getTaskRun(ctx context.Context, namespace, name string) (*v1.TaskRun, error) {
+	var tr v1.TaskRun
+	if err := c.getRun(ctx, namespace, resultsTaskRunType, name, &tr); err != nil {
+		return nil, err
+	}
+	return &tr, nil
+}
+
+// getPipelineRun returns the archived PipelineRun with the given name.
+func (c *resultsClient) getPipelineRun(ctx context.Context, namespace, name string) (*v1.PipelineRun, error) {
+	var pr v1.PipelineRun
+	if err := c.getRun(ctx, namespace, resultsPipelineRunType, name, &pr); err != nil {
+		return nil, err
+	}
+	return &pr, nil
+}
+
+// getRun decodes the newest record of the run of the data type with the
+// given name into v. Names are reused once runs are pruned, so several
+// records can match.
+func (c *resultsClient) getRun(ctx context.Context, namespace, dataType, name string, v interface{}) error {
+	filter := fmt.Sprintf(`data_type == %q && data.metadata.name == %q`, dataType, name)
+	records, err := c.listRecords(ctx, namespace, filter)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("%s %s/%s %w", strings.TrimPrefix(dataType, "tekton.dev/v1."), namespace, name, errResultsNotFound)
+	}
+	newest := records[0]
+	for _, record := range records[1:] {
+		if record.CreateTime.After(newest.CreateTime) {
+			newest = record
+		}
+	}
+	if err := json.Unmarshal(newest.Data.Value, v); err != nil {
+		return fmt.Errorf("failed to decode record %s: %w", newest.Name, err)
+	}
+	return nil
+}
+
+// listPipelineRuns returns the archived PipelineRuns of the namespace that
+// completed after since.
+func (c *resultsClient) listPipelineRuns(ctx context.Context, namespace string, since time.Time) ([]v1.PipelineRun, error) {
+	filter := fmt.Sprintf("data_type == %q", resultsPipelineRunType)
+	if !since.IsZero() {
+		filter += fmt.Sprintf(` && data.status.completionTime > timestamp(%q)`, since.UTC().Format(time.RFC3339))
+	}
+	records, err := c.listRecords(ctx, namespace, filter)
+	if err != nil {
+		return nil, err
+	}
+	runs := make([]v1.PipelineRun, 0, len(records))
+	for _, record := range records {
+		var pr v1.PipelineRun
+		if err := json.Unmarshal(record.Data.Value, &pr); err != nil {
+			return nil, fmt.Errorf("failed to decode record %s: %w", record.Name, err)
+		}
+		runs = append(runs, pr)
+	}
+	return runs, nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fakeResults serves records from memory the way the Results API does,
+// two per page.
+type fakeResults struct {
+	t       *testing.T
+	records map[string][]ResultsRecord
+	// requests counts the requests served
+	requests int
+}
+
+func (f *fakeResults) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests++
+	if got := r.Header.Get("Authorization"); got != "Bearer test-token" {
+		f.t.Errorf("Authorization = %q, want the bearer token", got)
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	// /apis/results.tekton.dev/v1alpha2/parents/<namespace>/results/-/records
+	if len(parts) != 9 || parts[8] != "records" {
+		http.NotFound(w, r)
+		return
+	}
+	records, ok := f.records[parts[5]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var matching []ResultsRecord
+	for _, record := range records {
+		if f.matches(r.URL.Query().Get("filter"), record) {
+			matching = append(matching, record)
+		}
+	}
+	start := 0
+	if token := r.URL.Query().Get("page_token"); token != "" {
+		start = len(token)
+	}
+	end := start + 2
+	page := ResultsRecordList{}
+	if end < len(matching) {
+		page.NextPageToken = strings.Repeat("x", end)
+	} else {
+		end = len(matching)
+	}
+	page.Records = matching[start:end]
+	json.NewEncoder(w).Encode(page)
+}
+
+// Filter clauses the listener sends, the fake fails the test on others.
+var (
+	dataTypeClause       = regexp.MustCompile(`^data_type == "([^"]*)"$`)
+	nameClause           = regexp.MustCompile(`^data\.metadata\.name == "([^"]*)"$`)
+	completionTimeClause = regexp.MustCompile(`^data\.status\.completionTime > timestamp\("([^"]*)"\)$`)
+)
+
+// matches evaluates the CEL filter against the record.
+func (f *fakeResults) matches(filter string, record ResultsRecord) bool {
+	var run struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+		Status   struct {
+			CompletionTime *metav1.Time `json:"completionTime"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(record.Data.Value, &run); err != nil {
+		f.t.Fatal(err)
+	}
+	for _, clause := range strings.Split(filter, " && ") {
+		if m := dataTypeClause.FindStringSubmatch(clause); m != nil {
+			if record.Data.Type != m[1] {
+				return false
+			}
+		} else if m := nameClause.FindStringSubmatch(clause); m != nil {
+			if run.Metadata.Name != m[1] {
+				return false
+			}
+		} else if m := completionTimeClause.FindStringSubmatch(clause); m != nil {
+			since, err := time.Parse(time.RFC3339, m[1])
+			if err != nil {
+				f.t.Errorf("filter %q has an invalid timestamp: %v", filter, err)
+			}
+			if run.Status.CompletionTime == nil || !run.Status.CompletionTime.After(since) {
+				return false
+			}
+		} else {
+			f.t.Errorf("unsupported filter clause %q in %q", clause, filter)
+			return false
+		}
+	}
+	return true
+}
+
+func resultsRecord(t *testing.T, dataType string, run interface{}) ResultsRecord {
+	t.Helper()
+	value, err := json.Marshal(run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record ResultsRecord
+	record.Data.Type = dataType
+	record.Data.Value = value
+	return record
+}
+
+func newFakeResults(t *testing.T, records map[string][]ResultsRecord) (*resultsClient, *fakeResults) {
+	t.Helper()
+	fake := &fakeResults{t: t, records: records}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("test-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	client, err := newResultsClient(server.URL+"/", tokenFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, fake
+}
+
+func TestResultsListPipelineRunsPaginates(t *testing.T) {
+	var records []ResultsRecord
+	for _, name := range []string{"build-1", "build-2", "build-3", "build-4", "build-5"} {
+		records = append(records, resultsRecord(t, resultsPipelineRunType, v1.PipelineRun{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ci"},
+		}))
+	}
+	records = append(records, resultsRecord(t, resultsTaskRunType, v1.TaskRun{
+		ObjectMeta: metav1.ObjectMeta{Name: "build-1-clone", Namespace: "ci"},
+	}))
+	client, fake := newFakeResults(t, map[string][]ResultsRecord{"ci": records})
+
+	runs, err := client.listPipelineRuns(context.Background(), "ci", time.Time{})
+	if err != nil {
+		t.Fatalf("listPipelineRuns: %v", err)
+	}
+	var names []string
+	for _, run := range runs {
+		names = append(names, run.Name)
+	}
+	if got, want := strings.Join(names, ","), "build-1,build-2,build-3,build-4,build-5"; got != want {
+		t.Errorf("PipelineRuns = %s, want %s", got, want)
+	}
+	if fake.requests != 3 {
+		t.Errorf("requests = %d, want 3 pages", fake.requests)
+	}
+}
+
+func TestResultsGetRun(t *testing.T) {
+	archived := func(dataType, name, uid string, created time.Time) ResultsRecord {
+		meta := metav1.ObjectMeta{Name: name, Namespace: "ci", UID: types.UID(uid)}
+		var record ResultsRecord
+		if dataType == resultsTaskRunType {
+			record = resultsRecord(t, dataType, v1.TaskRun{ObjectMeta: meta})
+		} else {
+			record = resultsRecord(t, dataType, v1.PipelineRun{ObjectMeta: meta})
+		}
+		record.CreateTime = created
+		return record
+	}
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	client, _ := newFakeResults(t, map[string][]ResultsRecord{
+		"ci": {
+			// a TaskRun and an older PipelineRun that had the same name
+			archived(resultsTaskRunType, "build-1-clone", "uid-1", day),
+			archived(resultsPipelineRunType, "build-1-clone", "uid-2", day),
+			archived(resultsTaskRunType, "build-2-clone", "uid-3", day),
+			archived(resultsPipelineRunType, "child", "uid-old", day),
+			archived(resultsPipelineRunType, "child", "uid-new", day.Add(time.Hour)),
+			archived(resultsPipelineRunType, "child", "uid-older", day.Add(-time.Hour)),
+		},
+		"empty": {},
+	})
+
+	tests := []struct {
+		name      string
+		pipeline  bool
+		namespace string
+		run       string
+		wantUID   string
+		notFound  bool
+	}{
+		{name: "task run", namespace: "ci", run: "build-1-clone", wantUID: "uid-1"},
+		{name: "other task run", namespace: "ci", run: "build-2-clone", wantUID: "uid-3"},
+		{name: "pipeline run of the same name", pipeline: true, namespace: "ci", run: "build-1-clone", wantUID: "uid-2"},
+		{name: "newest of reused name", pipeline: true, namespace: "ci", run: "child", wantUID: "uid-new"},
+		{name: "wrong type", namespace: "ci", run: "child", notFound: true},
+		{name: "no record", namespace: "empty", run: "build-1-clone", notFound: true},
+		{name: "unknown parent", namespace: "missing", run: "build-1-clone", notFound: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var uid types.UID
+			var err error
+			if tt.pipeline {
+				var pr *v1.PipelineRun
+				if pr, err = client.getPipelineRun(context.Background(), tt.namespace, tt.run); err == nil {
+					uid = pr.UID
+				}
+			} else {
+				var tr *v1.TaskRun
+				if tr, err = client.getTaskRun(context.Background(), tt.namespace, tt.run); err == nil {
+					uid = tr.UID
+				}
+			}
+			if tt.notFound {
+				if !errors.Is(err, errResultsNotFound) {
+					t.Fatalf("error = %v, want errResultsNotFound", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("get %s: %v", tt.run, err)
+			}
+			if string(uid) != tt.wantUID {
+				t.Errorf("UID = %s, want %s", uid, tt.wantUID)
+			}
+		})
+	}
+}
+
+func TestResultsListPipelineRunsSince(t *testing.T) {
+	since := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	var records []ResultsRecord
+	for i, name := range []string{"before", "after"} {
+		completed := metav1.NewTime(since.Add(time.Duration(2*i-1) * time.Minute))
+		pr := v1.PipelineRun{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		pr.Status.CompletionTime = &completed
+		records = append(records, resultsRecord(t, resultsPipelineRunType, pr))
+	}
+	client, _ := newFakeResults(t, map[string][]ResultsRecord{"ci": records})
+	runs, err := client.listPipelineRuns(context.Background(), "ci", since)
+	if err != nil {
+		t.Fatalf("listPipelineRuns: %v", err)
+	}
+	if len(runs) != 1 || runs[0].Name != "after" {
+		t.Errorf("PipelineRuns = %+v, want only the one completed after %s", runs, since)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+// receiverFunc handles a single CloudEvent; eventReceiver is the one used
+// by every transport.
+type receiverFunc func(ctx context.Context, event cloudevents.Event) error
+
+// eventTransport delivers CloudEvents to a receiver. start sets the
+// transport up, returning any configuration error, and keeps delivering in
+// the background until the context is done.
+type eventTransport interface {
+	start(ctx context.Context, fn receiverFunc) error
+}
+
+// newEventTransport creates the transport selected by EVENT_TRANSPORT.
+func newEventTransport(env envConfig, mux *http.ServeMux) (eventTransport, error) {
+	auth, err := newEventAuth(env.EventHMACSecret, env.EventTokensFile, env.EventSourceAllowlist)
+	if err != nil {
+		return nil, err
+	}
+	switch env.Transport {
+	case "http":
+		return &httpTransport{mux: mux, path: env.Path, auth: auth}, nil
+	case "kafka":
+		if env.KafkaRESTURL == "" || env.KafkaTopic == "" {
+			return nil, fmt.Errorf("the kafka transport requires KAFKA_REST_URL and KAFKA_TOPIC")
+		}
+		// The REST Proxy drops record headers, binary mode events would
+		// arrive without their attributes and all be dead-lettered.
+		if !env.KafkaStructuredMode {
+			return nil, fmt.Errorf("the kafka transport only reads structured or batch mode events, set KAFKA_STRUCTURED_MODE=true once producers send them")
+		}
+		return newKafkaTransport(env.KafkaRESTURL, env.KafkaTopic, env.KafkaConsumerGroup, auth), nil
+	}
+	return nil, fmt.Errorf("unknown transport %q, expected http or kafka", env.Transport)
+}
+
+// httpTransport receives CloudEvents POSTed to path, in binary, structured
+// or batch mode.
+type httpTransport struct {
+	mux  *http.ServeMux
+	path string
+	auth *eventAuth
+}
+
+func (t *httpTransport) start(ctx context.Context, fn receiverFunc) error {
+	p, err := cloudevents.NewHTTP()
+	if err != nil {
+		return fmt.Errorf("failed to create protocol: %w", err)
+	}
+	fn = t.auth.receiver(fn)
+	receiver, err := cloudevents.NewHTTPReceiveHandler(ctx, p, fn)
+	if err != nil {
+		return fmt.Errorf("failed to create receiver: %w", err)
+	}
+	t.mux.Handle(t.path, t.auth.middleware(&batchReceiver{single: receiver, fn: fn}))
+	return nil
+}
+
+// channelTransport delivers the events sent on a channel, it lets tests and
+// other in-process producers feed the listener without a network hop. The
+// result of each event is sent on results when it is set.
+type channelTransport struct {
+	events  <-chan cloudevents.Event
+	results chan<- error
+}
+
+func (t *channelTransport) start(ctx context.Context, fn receiverFunc) error {
+	go func() {
+		for {
+			select {
+			case event, ok := <-t.events:
+				if !ok {
+					return
+				}
+				err := fn(ctx, event)
+				if err != nil {
+					log.Printf("failed to handle event %s: %v", event.ID(), err)
+				}
+				if t.results != nil {
+					t.results <- err
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+func testEvent(id, eventType string) cloudevents.Event {
+	event := cloudevents.NewEvent()
+	event.SetID(id)
+	event.SetSource("/tekton")
+	event.SetType(eventType)
+	return event
+}
+
+// TestChannelTransport feeds eventReceiver through the in-process
+// transport, with and without a queue.
+func TestChannelTransport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan cloudevents.Event)
+	results := make(chan error)
+	transport := &channelTransport{events: events, results: results}
+	if err := transport.start(ctx, eventReceiver); err != nil {
+		t.Fatal(err)
+	}
+
+	// events without a handler are ignored without touching the store
+	events <- testEvent("unsupported", "dev.example.unsupported")
+	if err := <-results; err != nil {
+		t.Errorf("unsupported event: %v", err)
+	}
+
+	queue, err := newWALQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventQueue = queue
+	defer func() { eventQueue = nil }()
+	events <- testEvent("queued", pipelineRunSuccessfulEvent)
+	if err := <-results; err != nil {
+		t.Fatalf("queued event: %v", err)
+	}
+	pending, err := queue.pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Errorf("queue holds %d events, want the received one", len(pending))
+	}
+}
+
+func TestChannelTransportStopsWhenClosed(t *testing.T) {
+	events := make(chan cloudevents.Event)
+	done := make(chan struct{})
+	transport := &channelTransport{events: events}
+	err := transport.start(context.Background(), func(ctx context.Context, event cloudevents.Event) error {
+		close(done)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events <- testEvent("last", pipelineRunSuccessfulEvent)
+	<-done
+	close(events)
+}
+
+func TestNewEventTransport(t *testing.T) {
+	kafka := envConfig{Transport: "kafka", KafkaRESTURL: "http://kafka-rest:8082", KafkaTopic: "tekton"}
+	structured := kafka
+	structured.KafkaStructuredMode = true
+	noTopic := structured
+	noTopic.KafkaTopic = ""
+
+	tests := []struct {
+		name    string
+		env     envConfig
+		wantErr string
+	}{
+		{name: "http", env: envConfig{Transport: "http", Path: "/"}},
+		{name: "kafka in structured mode", env: structured},
+		{name: "kafka without structured mode", env: kafka, wantErr: "KAFKA_STRUCTURED_MODE"},
+		{name: "kafka without topic", env: noTopic, wantErr: "KAFKA_TOPIC"},
+		{name: "unknown", env: envConfig{Transport: "nats"}, wantErr: "unknown transport"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newEventTransport(tt.env, http.NewServeMux())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("newEventTransport: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want one mentioning %s", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Metadata naming who or what created a Tekton run.
+const (
+	pacSenderAnnotation        = "pipelinesascode.tekton.dev/sender"
+	triggersEventListenerLabel = "triggers.tekton.dev/eventlistener"
+	triggersTriggerLabel       = "triggers.tekton.dev/trigger"
+)
+
+// unknownActor is recorded for runs created by hand with a client such as
+// kubectl or tkn, which does not tell who ran it.
+const unknownActor = "unknown"
+
+// handClients are the field managers of the clients people create runs
+// with: kubectl, oc, tkn and the OpenShift console, which is known by the
+// browser's user agent.
+var handClients = []string{"kubectl", "oc", "tkn", "Mozilla"}
+
+// maxCachedAuthors bounds the commit authors kept by an actorResolver.
+const maxCachedAuthors = 1000
+
+// actors resolves who triggered Tekton runs. Its identity mapping and
+// GitHub client are set up from the environment at start.
+var actors = &actorResolver{}
+
+// Identity is the corporate identity of a git user.
+type Identity struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// actorResolver attributes Tekton runs to the user that triggered them.
+type actorResolver struct {
+	// identities maps git logins to corporate identities
+	identities map[string]Identity
+	// github looks up the author of commits when no sender is known, it is
+	// nil when no GitHub token is configured
+	github *githubClient
+
+	mu sync.Mutex
+	// authors caches the commit authors looked up on GitHub by repo@sha
+	authors map[string]commitAuthorEntry
+}
+
+// commitAuthorEntry is a cached commitAuthor result.
+type commitAuthorEntry struct {
+	login  string
+	author Identity
+	ok     bool
+}
+
+// setupActors loads the identity mapping in the IDENTITY_MAP_FILE named in
+// the environment, a YAML or JSON object keyed by git login:
+//
+//	jdoe:
+//	  name: Jane Doe
+//	  email: jdoe@example.com
+func setupActors(github *githubClient) error {
+	actors.github = github
+	file := os.Getenv("IDENTITY_MAP_FILE")
+	if file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		log.Printf("identity mapping %s does not exist, git users are recorded as is", file)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read identity mapping: %w", err)
+	}
+	var identities map[string]Identity
+	if err := yaml.UnmarshalStrict(data, &identities); err != nil {
+		return fmt.Errorf("failed to parse identity mapping: %w", err)
+	}
+	actors.identities = identities
+	return nil
+}
+
+// triggeredBy resolves who triggered a run, trying in turn the
+// Pipelines-as-Code sender, the author of the commit on GitHub, the
+// Triggers EventListener and the field manager that created the run, which
+// names the controller that did but only the client of runs created by
+// hand. The commit author is only looked up for finished runs, since the record of
+// an unfinished run is replaced once it finishes.
+func (r *actorResolver) triggeredBy(ctx context.Context, meta metav1.ObjectMeta, source sourceInfo, lastActivity int64, finished bool) TriggeredBy {
+	if sender := meta.Annotations[pacSenderAnnotation]; sender != "" {
+		return r.user(sender, Identity{}, lastActivity)
+	}
+	if finished {
+		if login, author, ok := r.commitAuthor(ctx, source); ok {
+			return r.user(login, author, lastActivity)
+		}
+	}
+	if listener := meta.Labels[triggersEventListenerLabel]; listener != "" {
+		name := listener
+		if trigger := meta.Labels[triggersTriggerLabel]; trigger != "" {
+			name += "/" + trigger
+		}
+		return TriggeredBy{Name: name, AccountId: "eventlistener:" + listener, LastActivity: lastActivity}
+	}
+	manager := creator(meta)
+	if manager == "" {
+		return TriggeredBy{Name: "Pipelines Operator", LastActivity: lastActivity}
+	}
+	if createdByHand(manager) {
+		return TriggeredBy{Name: unknownActor, LastActivity: lastActivity}
+	}
+	return TriggeredBy{Name: manager, AccountId: "manager:" + manager, LastActivity: lastActivity}
+}
+
+// user returns the git user with the login, replaced by their corporate
+// identity when the mapping has one.
+func (r *actorResolver) user(login string, known Identity, lastActivity int64) TriggeredBy {
+	identity, ok := r.identities[login]
+	if !ok {
+		identity = known
+	}
+	if identity.Name == "" {
+		identity.Name = login
+	}
+	if login == "" {
+		login = identity.Email
+	}
+	return TriggeredBy{
+		Name:         identity.Name,
+		Email:        identity.Email,
+		AccountId:    login,
+		LastActivity: lastActivity,
+	}
+}
+
+// GitHubCommit is the part of a commit returned by the GitHub API that
+// identifies its author.
+type GitHubCommit struct {
+	Author *struct {
+		Login string `json:"login"`
+	} `json:"author"`
+	Commit struct {
+		Author struct {
+			Name  string `json:"name"`
+			Email string `json:"email"`
+		} `json:"author"`
+	} `json:"commit"`
+}
+
+// commitAuthor looks up the author of the commit a run built on GitHub.
+// Commits are immutable, so authors are cached; failed lookups are not.
+func (r *actorResolver) commitAuthor(ctx context.Context, source sourceInfo) (string, Identity, bool) {
+	if r.github == nil || source.commit == "" {
+		return "", Identity{}, false
+	}
+	repo, ok := githubRepo(source.repoURL)
+	if !ok {
+		return "", Identity{}, false
+	}
+	key := repo + "@" + source.commit
+	r.mu.Lock()
+	entry, cached := r.authors[key]
+	r.mu.Unlock()
+	if cached {
+		return entry.login, entry.author, entry.ok
+	}
+	var commit GitHubCommit
+	endpoint := fmt.Sprintf("%s/repos/%s/commits/%s", r.github.baseURL, repo, url.PathEscape(source.commit))
+	if _, err := r.github.getJSON(ctx, endpoint, &commit); err != nil {
+		log.Printf("failed to look up author of %s: %v", key, err)
+		return "", Identity{}, false
+	}
+	entry = commitAuthorEntry{author: Identity{Name: commit.Commit.Author.Name, Email: commit.Commit.Author.Email}}
+	if commit.Author != nil {
+		entry.login = commit.Author.Login
+	}
+	entry.ok = entry.login != "" || entry.author.Email != ""
+	r.mu.Lock()
+	if r.authors == nil || len(r.authors) >= maxCachedAuthors {
+		r.authors = make(map[string]commitAuthorEntry)
+	}
+	r.authors[key] = entry
+	r.mu.Unlock()
+	return entry.login, entry.author, entry.ok
+}
+
+// githubRepo returns the owner/repo of a github.com repository URL.
+func githubRepo(repoURL string) (string, bool) {
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Host != "github.com" {
+		return "", false
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 {
+		return "", false
+	}
+	return parts[0] + "/" + strings.TrimSuffix(parts[1], ".git"), true
+}
+
+// createdByHand reports whether the field manager is a client people create
+// runs with, such as kubectl-create.
+func createdByHand(manager string) bool {
+	for _, client := range handClients {
+		if manager == client || strings.HasPrefix(manager, client+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// creator returns the field manager that created the object, such as
+// kubectl-create or tkn for runs started by hand. Managers name the client
+// used, not the user.
+func creator(meta metav1.ObjectMeta) string {
+	var first *metav1.ManagedFieldsEntry
+	for i := range meta.ManagedFields {
+		entry := &meta.ManagedFields[i]
+		if entry.Time == nil {
+			continue
+		}
+		if first == nil || entry.Time.Before(first.Time) {
+			first = entry
+		}
+	}
+	if first == nil && len(meta.ManagedFields) > 0 {
+		first = &meta.ManagedFields[0]
+	}
+	if first == nil {
+		return ""
+	}
+	return first.Manager
+}
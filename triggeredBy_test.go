@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTriggeredBy(t *testing.T) {
+	at := func(minute int) *metav1.Time {
+		t := metav1.NewTime(time.Date(2024, 5, 1, 10, minute, 0, 0, time.UTC))
+		return &t
+	}
+	managed := func(entries ...metav1.ManagedFieldsEntry) metav1.ObjectMeta {
+		return metav1.ObjectMeta{ManagedFields: entries}
+	}
+	resolver := &actorResolver{identities: map[string]Identity{
+		"jdoe": {Name: "Jane Doe", Email: "jdoe@example.com"},
+	}}
+
+	tests := []struct {
+		name string
+		meta metav1.ObjectMeta
+		want TriggeredBy
+	}{
+		{
+			name: "Pipelines as Code sender",
+			meta: metav1.ObjectMeta{Annotations: map[string]string{pacSenderAnnotation: "jdoe"}},
+			want: TriggeredBy{Name: "Jane Doe", Email: "jdoe@example.com", AccountId: "jdoe"},
+		},
+		{
+			name: "Triggers EventListener",
+			meta: metav1.ObjectMeta{Labels: map[string]string{triggersEventListenerLabel: "github", triggersTriggerLabel: "push"}},
+			want: TriggeredBy{Name: "github/push", AccountId: "eventlistener:github"},
+		},
+		{
+			name: "kubectl",
+			meta: managed(metav1.ManagedFieldsEntry{Manager: "kubectl-create", Time: at(0)}),
+			want: TriggeredBy{Name: unknownActor},
+		},
+		{
+			name: "tkn",
+			meta: managed(metav1.ManagedFieldsEntry{Manager: "tkn"}),
+			want: TriggeredBy{Name: unknownActor},
+		},
+		{
+			name: "console",
+			meta: managed(metav1.ManagedFieldsEntry{Manager: "Mozilla", Time: at(0)}),
+			want: TriggeredBy{Name: unknownActor},
+		},
+		{
+			name: "controller",
+			meta: managed(
+				metav1.ManagedFieldsEntry{Manager: "controller", Time: at(1)},
+				metav1.ManagedFieldsEntry{Manager: "argocd-controller", Time: at(0)},
+			),
+			want: TriggeredBy{Name: "argocd-controller", AccountId: "manager:argocd-controller"},
+		},
+		{
+			name: "manager named like a client",
+			meta: managed(metav1.ManagedFieldsEntry{Manager: "operator", Time: at(0)}),
+			want: TriggeredBy{Name: "operator", AccountId: "manager:operator"},
+		},
+		{
+			name: "no managed fields",
+			want: TriggeredBy{Name: "Pipelines Operator"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := resolver.triggeredBy(context.Background(), tt.meta, sourceInfo{}, 0, true)
+			if got != tt.want {
+				t.Errorf("triggeredBy = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
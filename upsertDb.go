@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -97,32 +98,215 @@ func putItem(c *dynamodb.Client, tableName string, item DynoNotation) (err error
 	return nil
 }
 
-// // putItems batch inserts multiple items in to a dynamodb table.
-// func putItems(c *dynamodb.Client, tableName string, items []DynoNotation) (err error) {
-// 	// dynamodb batch limit is 25
-// 	if len(items) > 25 {
-// 		return fmt.Errorf("Max batch size is 25, attempted `%d`", len(items))
-// 	}
+// storeBuild writes a build record, replacing any earlier version of it.
+func storeBuild(c *dynamodb.Client, tableName string, payload CiBuildPayload) error {
+	item, err := attributevalue.MarshalMap(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	return putItem(c, tableName, item)
+}
 
-// 	// create requests
-// 	writeRequests := make([]types.WriteRequest, len(items))
-// 	for i, item := range items {
-// 		writeRequests[i] = types.WriteRequest{PutRequest: &types.PutRequest{Item: item}}
-// 	}
+// getBuild returns the stored build with the given key, or nil when there is
+// no such build.
+func getBuild(c *dynamodb.Client, tableName, origin, originalID string) (*CiBuildPayload, error) {
+	key, err := attributevalue.MarshalMap(map[string]string{
+		"origin":     origin,
+		"originalID": originalID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(tableName), Key: key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Item == nil {
+		return nil, nil
+	}
+	var payload CiBuildPayload
+	if err := attributevalue.UnmarshalMap(resp.Item, &payload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal record: %w", err)
+	}
+	return &payload, nil
+}
 
-// 	// write batch
-// 	_, err = c.BatchWriteItem(
-// 		context.TODO(),
-// 		&dynamodb.BatchWriteItemInput{
-// 			RequestItems: map[string][]types.WriteRequest{tableName: writeRequests},
-// 		},
-// 	)
-// 	if err != nil {
-// 		return err
-// 	}
+// putInProgressItem stores a build that has not finished yet. The write is
+// conditional on the stored record not being complete, so a late running
+// event never overwrites the final state of a build. It reports whether
+// the item was written.
+func putInProgressItem(c *dynamodb.Client, tableName string, payload CiBuildPayload) (bool, error) {
+	item, err := attributevalue.MarshalMap(payload)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal record: %w", err)
+	}
+	cond := expression.AttributeNotExists(expression.Name("completedAt"))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return false, err
+	}
+	_, err = c.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:                aws.String(tableName),
+		Item:                     item,
+		ConditionExpression:      expr.Condition(),
+		ExpressionAttributeNames: expr.Names(),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-// 	return nil
-// }
+// eventMarkerOrigin is the origin of the items marking processed events.
+// Markers share the table with builds and expire through the expiresAt TTL
+// attribute, when TTL is enabled on the table.
+const eventMarkerOrigin = "ProcessedEvent"
+
+// eventMarkerTTL is how long event markers are kept.
+const eventMarkerTTL = 7 * 24 * time.Hour
+
+// States of an event marker.
+const (
+	eventMarkerProcessing = "processing"
+	eventMarkerDone       = "done"
+)
+
+// EventMarker records that a CloudEvent is being or was processed. Markers
+// written before states existed have none and count as done.
+type EventMarker struct {
+	Origin      string `dynamodbav:"origin"`
+	OriginalID  string `dynamodbav:"originalID"`
+	State       string `dynamodbav:"state,omitempty"`
+	ProcessedAt int64  `dynamodbav:"processedAt"`
+	// LeaseExpiresAt is when the claim of a marker being processed lapses
+	LeaseExpiresAt int64 `dynamodbav:"leaseExpiresAt,omitempty"`
+	ExpiresAt      int64 `dynamodbav:"expiresAt"`
+}
+
+// claimEventMarker writes a processing marker for the event key holding a
+// lease, unless a marker exists that is done or whose lease is still
+// running. It reports whether the marker was claimed.
+func claimEventMarker(c *dynamodb.Client, tableName, key string, lease time.Duration) (bool, error) {
+	now := time.Now()
+	item, err := attributevalue.MarshalMap(EventMarker{
+		Origin:         eventMarkerOrigin,
+		OriginalID:     key,
+		State:          eventMarkerProcessing,
+		ProcessedAt:    now.Unix(),
+		LeaseExpiresAt: now.Add(lease).Unix(),
+		ExpiresAt:      now.Add(eventMarkerTTL).Unix(),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal marker: %w", err)
+	}
+	cond := expression.AttributeNotExists(expression.Name("originalID")).Or(
+		expression.Name("state").Equal(expression.Value(eventMarkerProcessing)).
+			And(expression.Name("leaseExpiresAt").LessThan(expression.Value(now.Unix()))))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return false, err
+	}
+	_, err = c.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:                 aws.String(tableName),
+		Item:                      item,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// completeEventMarker marks the event key as done.
+func completeEventMarker(c *dynamodb.Client, tableName, key string) error {
+	now := time.Now()
+	item, err := attributevalue.MarshalMap(EventMarker{
+		Origin:      eventMarkerOrigin,
+		OriginalID:  key,
+		State:       eventMarkerDone,
+		ProcessedAt: now.Unix(),
+		ExpiresAt:   now.Add(eventMarkerTTL).Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal marker: %w", err)
+	}
+	return putItem(c, tableName, item)
+}
+
+// releaseEventMarker removes the marker of the event key if it is still
+// being processed.
+func releaseEventMarker(c *dynamodb.Client, tableName, key string) error {
+	item, err := attributevalue.MarshalMap(map[string]string{
+		"origin":     eventMarkerOrigin,
+		"originalID": key,
+	})
+	if err != nil {
+		return err
+	}
+	cond := expression.Name("state").Equal(expression.Value(eventMarkerProcessing))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+	_, err = c.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       item,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return nil
+	}
+	return err
+}
+
+// putItems batch inserts multiple items in to a dynamodb table, retrying
+// any items DynamoDB leaves unprocessed.
+func putItems(c *dynamodb.Client, tableName string, items []DynoNotation) (err error) {
+	// dynamodb batch limit is 25
+	if len(items) > 25 {
+		return fmt.Errorf("Max batch size is 25, attempted `%d`", len(items))
+	}
+
+	// create requests
+	writeRequests := make([]types.WriteRequest, len(items))
+	for i, item := range items {
+		writeRequests[i] = types.WriteRequest{PutRequest: &types.PutRequest{Item: item}}
+	}
+
+	// write batch
+	requests := map[string][]types.WriteRequest{tableName: writeRequests}
+	for attempt := 0; len(requests) > 0; attempt++ {
+		if attempt == 5 {
+			return fmt.Errorf("%d items left unprocessed", len(requests[tableName]))
+		}
+		time.Sleep(time.Duration(attempt*attempt) * 100 * time.Millisecond)
+		out, err := c.BatchWriteItem(
+			context.TODO(),
+			&dynamodb.BatchWriteItemInput{RequestItems: requests},
+		)
+		if err != nil {
+			return err
+		}
+		requests = out.UnprocessedItems
+	}
+
+	return nil
+}
 
 // // getItem returns an item if found based on the key provided.
 // // the key could be either a primary or composite key and values map.
@@ -135,9 +319,9 @@ func putItem(c *dynamodb.Client, tableName string, item DynoNotation) (err error
 // 	return resp.Item, nil //
 // }
 
-func getCiBuildPayload(client *dynamodb.Client) []CiBuildPayload {
+func getCiBuildPayload(client *dynamodb.Client, origin string) []CiBuildPayload {
 	var payload []CiBuildPayload
-	originAttr, _ := attributevalue.Marshal("Tekton")
+	originAttr, _ := attributevalue.Marshal(origin)
 	keyExpr := expression.Key("origin").Equal(expression.Value(originAttr))
 	expr, err := expression.NewBuilder().WithKeyCondition(keyExpr).Build()
 	if err != nil {
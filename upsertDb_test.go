@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// fakeDynamoDB serves GetItem, PutItem and DeleteItem from memory over the
+// DynamoDB JSON protocol, evaluating the condition expressions the listener
+// sends.
+type fakeDynamoDB struct {
+	t *testing.T
+
+	mu sync.Mutex
+	// items are keyed by table, origin and originalID
+	items map[string]map[string]json.RawMessage
+}
+
+type dynamoRequest struct {
+	TableName                 string
+	Item                      map[string]json.RawMessage
+	Key                       map[string]json.RawMessage
+	ConditionExpression       string
+	ExpressionAttributeNames  map[string]string
+	ExpressionAttributeValues map[string]json.RawMessage
+}
+
+// newFakeDynamoDB starts the fake and returns a client of it.
+func newFakeDynamoDB(t *testing.T) (*dynamodb.Client, *fakeDynamoDB) {
+	t.Helper()
+	fake := &fakeDynamoDB{t: t, items: make(map[string]map[string]json.RawMessage)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(server.URL),
+		Credentials:      aws.AnonymousCredentials{},
+		RetryMaxAttempts: 1,
+	})
+	return client, fake
+}
+
+func (f *fakeDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req dynamoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.t.Errorf("invalid DynamoDB request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	switch operation {
+	case "GetItem":
+		item, ok := f.items[f.key(req.TableName, req.Key)]
+		if !ok {
+			w.Write([]byte("{}"))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Item": item})
+	case "PutItem", "DeleteItem":
+		key := req.Key
+		if operation == "PutItem" {
+			key = req.Item
+		}
+		id := f.key(req.TableName, key)
+		if req.ConditionExpression != "" && !f.condition(req, f.items[id]) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type": "com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException", "message": "The conditional request failed"}`))
+			return
+		}
+		if operation == "PutItem" {
+			f.items[id] = req.Item
+		} else {
+			delete(f.items, id)
+		}
+		w.Write([]byte("{}"))
+	default:
+		f.t.Errorf("unsupported DynamoDB operation %q", operation)
+		http.Error(w, "unsupported operation", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeDynamoDB) key(table string, item map[string]json.RawMessage) string {
+	return table + "/" + f.value(item["origin"]) + "/" + f.value(item["originalID"])
+}
+
+// value returns the string or number held by an attribute value.
+func (f *fakeDynamoDB) value(raw json.RawMessage) string {
+	if raw == nil {
+		return ""
+	}
+	var attr struct {
+		S *string
+		N *string
+	}
+	if err := json.Unmarshal(raw, &attr); err != nil {
+		f.t.Fatalf("invalid attribute value %s: %v", raw, err)
+	}
+	switch {
+	case attr.S != nil:
+		return *attr.S
+	case attr.N != nil:
+		return *attr.N
+	}
+	f.t.Fatalf("unsupported attribute value %s", raw)
+	return ""
+}
+
+// get returns the item stored under the key, or nil.
+func (f *fakeDynamoDB) get(table, origin, originalID string) map[string]json.RawMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.items[table+"/"+origin+"/"+originalID]
+}
+
+var conditionToken = regexp.MustCompile(`\(|\)|[#:]\w+|=|<|\w+`)
+
+// condition evaluates the condition expression of the request against the
+// stored item, which is nil when there is none. It supports
+// attribute_not_exists, = and < joined by AND and OR.
+func (f *fakeDynamoDB) condition(req dynamoRequest, item map[string]json.RawMessage) bool {
+	tokens := conditionToken.FindAllString(req.ConditionExpression, -1)
+	next := func() string {
+		if len(tokens) == 0 {
+			f.t.Fatalf("truncated condition %q", req.ConditionExpression)
+		}
+		token := tokens[0]
+		tokens = tokens[1:]
+		return token
+	}
+	expect := func(want string) {
+		if got := next(); got != want {
+			f.t.Fatalf("condition %q has %q where %q was expected", req.ConditionExpression, got, want)
+		}
+	}
+	operand := func() (string, bool) {
+		token := next()
+		if strings.HasPrefix(token, ":") {
+			return f.value(req.ExpressionAttributeValues[token]), true
+		}
+		raw, ok := item[req.ExpressionAttributeNames[token]]
+		if !ok {
+			return "", false
+		}
+		return f.value(raw), true
+	}
+	var or func() bool
+	term := func() bool {
+		if tokens[0] == "(" {
+			next()
+			result := or()
+			expect(")")
+			return result
+		}
+		if tokens[0] == "attribute_not_exists" {
+			next()
+			expect("(")
+			_, exists := operand()
+			expect(")")
+			return !exists
+		}
+		left, leftOK := operand()
+		op := next()
+		right, rightOK := operand()
+		if !leftOK || !rightOK {
+			return false
+		}
+		switch op {
+		case "=":
+			return left == right
+		case "<":
+			l, err1 := strconv.ParseFloat(left, 64)
+			r, err2 := strconv.ParseFloat(right, 64)
+			if err1 != nil || err2 != nil {
+				return left < right
+			}
+			return l < r
+		}
+		f.t.Fatalf("unsupported operator %q in %q", op, req.ConditionExpression)
+		return false
+	}
+	and := func() bool {
+		result := term()
+		for len(tokens) > 0 && tokens[0] == "AND" {
+			next()
+			result = term() && result
+		}
+		return result
+	}
+	or = func() bool {
+		result := and()
+		for len(tokens) > 0 && tokens[0] == "OR" {
+			next()
+			result = and() || result
+		}
+		return result
+	}
+	result := or()
+	if len(tokens) != 0 {
+		f.t.Fatalf("unsupported condition %q", req.ConditionExpression)
+	}
+	return result
+}
+
+func TestPutInProgressItem(t *testing.T) {
+	client, _ := newFakeDynamoDB(t)
+	running := CiBuildPayload{Origin: "Tekton", OriginalID: "uid-1", Name: "build", Status: "Succeeded", Conclusion: "Unknown"}
+	stored, err := putInProgressItem(client, "TektonCI", running)
+	if err != nil || !stored {
+		t.Fatalf("putInProgressItem = %v, %v, want the running build stored", stored, err)
+	}
+	completed := running
+	completed.Conclusion = "True"
+	completed.CompletedAt = 1714557600
+	if err := storeBuild(client, "TektonCI", completed); err != nil {
+		t.Fatal(err)
+	}
+	// a late running event must not overwrite the final state
+	stored, err = putInProgressItem(client, "TektonCI", running)
+	if err != nil || stored {
+		t.Fatalf("putInProgressItem = %v, %v, want the completed build kept", stored, err)
+	}
+	build, err := getBuild(client, "TektonCI", "Tekton", "uid-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build == nil || build.CompletedAt != completed.CompletedAt || build.Conclusion != "True" {
+		t.Errorf("stored build = %+v, want the completed one", build)
+	}
+	if build, err := getBuild(client, "TektonCI", "Tekton", "uid-2"); err != nil || build != nil {
+		t.Errorf("getBuild of a missing build = %+v, %v, want nil", build, err)
+	}
+}
+
+func TestEventMarkers(t *testing.T) {
+	client, fake := newFakeDynamoDB(t)
+	claim := func(key string, lease time.Duration) bool {
+		t.Helper()
+		claimed, err := claimEventMarker(client, "TektonCI", key, lease)
+		if err != nil {
+			t.Fatalf("claimEventMarker: %v", err)
+		}
+		return claimed
+	}
+
+	if !claim("source/1", eventLease) {
+		t.Fatal("a new event was not claimed")
+	}
+	if claim("source/1", eventLease) {
+		t.Error("an event being processed was claimed again")
+	}
+	if err := completeEventMarker(client, "TektonCI", "source/1"); err != nil {
+		t.Fatal(err)
+	}
+	if claim("source/1", eventLease) {
+		t.Error("a processed event was claimed again")
+	}
+	if err := releaseEventMarker(client, "TektonCI", "source/1"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.get("TektonCI", eventMarkerOrigin, "source/1") == nil {
+		t.Error("releasing a processed event removed its marker")
+	}
+
+	// a claim whose lease lapsed, as one of a replica that died, is taken
+	// over
+	if !claim("source/2", -time.Minute) {
+		t.Fatal("a new event was not claimed")
+	}
+	if !claim("source/2", eventLease) {
+		t.Error("an event whose lease expired was not claimed")
+	}
+	if claim("source/2", eventLease) {
+		t.Error("an event was claimed again within its lease")
+	}
+
+	// a released claim is taken again when the event is redelivered
+	if err := releaseEventMarker(client, "TektonCI", "source/2"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.get("TektonCI", eventMarkerOrigin, "source/2") != nil {
+		t.Error("releasing a claimed event kept its marker")
+	}
+	if !claim("source/2", eventLease) {
+		t.Error("a released event was not claimed")
+	}
+}
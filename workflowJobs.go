@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+)
+
+type WorkflowJobs struct {
+	TotalCount int           `json:"total_count"`
+	Jobs       []WorkflowJob `json:"jobs"`
+}
+
+type WorkflowJob struct {
+	ID              int64      `json:"id"`
+	RunID           int64      `json:"run_id"`
+	RunURL          string     `json:"run_url"`
+	RunAttempt      int        `json:"run_attempt"`
+	NodeID          string     `json:"node_id"`
+	HeadSha         string     `json:"head_sha"`
+	HeadBranch      string     `json:"head_branch"`
+	URL             string     `json:"url"`
+	HTMLURL         string     `json:"html_url"`
+	Status          string     `json:"status"`
+	Conclusion      string     `json:"conclusion"`
+	CreatedAt       time.Time  `json:"created_at"`
+	StartedAt       time.Time  `json:"started_at"`
+	CompletedAt     *time.Time `json:"completed_at"`
+	Name            string     `json:"name"`
+	WorkflowName    string     `json:"workflow_name"`
+	Steps           []JobStep  `json:"steps"`
+	Labels          []string   `json:"labels"`
+	RunnerID        int64      `json:"runner_id"`
+	RunnerName      string     `json:"runner_name"`
+	RunnerGroupID   int64      `json:"runner_group_id"`
+	RunnerGroupName string     `json:"runner_group_name"`
+}
+
+type JobStep struct {
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	Conclusion  string     `json:"conclusion"`
+	Number      int        `json:"number"`
+	StartedAt   *time.Time `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+type PullRequest struct {
+	URL    string `json:"url"`
+	ID     int64  `json:"id"`
+	Number int    `json:"number"`
+	Head   struct {
+		Ref string `json:"ref"`
+		Sha string `json:"sha"`
+	} `json:"head"`
+	Base struct {
+		Ref string `json:"ref"`
+		Sha string `json:"sha"`
+	} `json:"base"`
+}
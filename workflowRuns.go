@@ -26,7 +26,7 @@ type Workflow struct {
 	CheckSuiteNodeID string        `json:"check_suite_node_id"`
 	URL              string        `json:"url"`
 	HTMLURL          string        `json:"html_url"`
-	PullRequests     []interface{} `json:"pull_requests"`
+	PullRequests     []PullRequest `json:"pull_requests"`
 	CreatedAt        time.Time     `json:"created_at"`
 	UpdatedAt        time.Time     `json:"updated_at"`
 	Actor            struct {